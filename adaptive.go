@@ -0,0 +1,86 @@
+package esbulk
+
+import (
+	"context"
+	"time"
+)
+
+// batchSizer adapts the batch size of a worker to the push-back of the
+// cluster, additive increase, multiplicative decrease: the size grows by a
+// fixed step after each fast request and is halved, if a request is
+// rejected as too many requests or takes much longer per document than the
+// fastest one seen so far. It only keeps state, so it can be fed any
+// sequence of observations.
+type batchSizer struct {
+	size     int
+	min, max int
+	step     int
+	best     float64 // Lowest seconds per document seen, slowly decaying.
+}
+
+// newBatchSizer starts at size, bounded by min and max, which defaults to ten
+// times the size. The step is a tenth of the starting size.
+func newBatchSizer(size, min, max int) *batchSizer {
+	if min < 1 {
+		min = 1
+	}
+	if max <= 0 {
+		max = 10 * size
+	}
+	if max < min {
+		max = min
+	}
+	if size < min {
+		size = min
+	}
+	if size > max {
+		size = max
+	}
+	step := size / 10
+	if step < 1 {
+		step = 1
+	}
+	return &batchSizer{size: size, min: min, max: max, step: step}
+}
+
+// observe updates the size after a bulk request with a number of docs, that
+// took some time and returned an error, if any, sent with a context. It
+// returns true, if the size was decreased.
+func (b *batchSizer) observe(ctx context.Context, docs int, took time.Duration, err error) bool {
+	if docs == 0 {
+		return false
+	}
+	if isRetryable(ctx, err) {
+		return b.decrease()
+	}
+	if _, ok := err.(*ItemsError); err != nil && !ok {
+		// Other errors say nothing about the load of the cluster.
+		return false
+	}
+	perDoc := took.Seconds() / float64(docs)
+	// Let the best value decay, so a single lucky request does not shrink
+	// batches forever.
+	b.best *= 1.01
+	if b.best == 0 || perDoc < b.best {
+		b.best = perDoc
+	}
+	if perDoc > 2*b.best {
+		return b.decrease()
+	}
+	b.size += b.step
+	if b.size > b.max {
+		b.size = b.max
+	}
+	return false
+}
+
+func (b *batchSizer) decrease() bool {
+	if b.size == b.min {
+		return false
+	}
+	b.size /= 2
+	if b.size < b.min {
+		b.size = b.min
+	}
+	return true
+}
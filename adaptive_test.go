@@ -0,0 +1,79 @@
+package esbulk
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBatchSizer(t *testing.T) {
+	type obs struct {
+		docs int
+		took time.Duration
+		err  error
+	}
+	tooMany := &StatusError{StatusCode: 429}
+	var cases = []struct {
+		about          string
+		size, min, max int
+		seq            []obs
+		want           []int
+	}{
+		{
+			about: "additive increase",
+			size:  100,
+			seq:   []obs{{100, 100 * time.Millisecond, nil}, {110, 110 * time.Millisecond, nil}, {120, 120 * time.Millisecond, nil}},
+			want:  []int{110, 120, 130},
+		},
+		{
+			about: "halved on too many requests",
+			size:  100,
+			seq:   []obs{{100, 100 * time.Millisecond, tooMany}, {50, 50 * time.Millisecond, tooMany}},
+			want:  []int{50, 25},
+		},
+		{
+			about: "halved on rising latency",
+			size:  100,
+			seq:   []obs{{100, 100 * time.Millisecond, nil}, {110, 1100 * time.Millisecond, nil}, {55, 55 * time.Millisecond, nil}},
+			want:  []int{110, 55, 65},
+		},
+		{
+			about: "capped at max",
+			size:  100,
+			max:   105,
+			seq:   []obs{{100, 100 * time.Millisecond, nil}, {105, 105 * time.Millisecond, nil}},
+			want:  []int{105, 105},
+		},
+		{
+			about: "bounded by min",
+			size:  10,
+			min:   8,
+			seq:   []obs{{10, time.Millisecond, tooMany}, {8, time.Millisecond, tooMany}},
+			want:  []int{8, 8},
+		},
+		{
+			about: "other errors ignored",
+			size:  100,
+			seq:   []obs{{100, time.Second, &StatusError{StatusCode: 400}}},
+			want:  []int{100},
+		},
+		{
+			about: "rejected documents are no push-back",
+			size:  100,
+			seq:   []obs{{100, 100 * time.Millisecond, &ItemsError{Failed: 1, Total: 100}}},
+			want:  []int{110},
+		},
+	}
+	for _, c := range cases {
+		b := newBatchSizer(c.size, c.min, c.max)
+		var got []int
+		for _, o := range c.seq {
+			b.observe(context.Background(), o.docs, o.took, o.err)
+			got = append(got, b.size)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.about, got, c.want)
+		}
+	}
+}
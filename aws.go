@@ -0,0 +1,91 @@
+package esbulk
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// SigV4Transport signs requests with AWS Signature Version 4, as required by
+// Amazon OpenSearch Service domains with IAM authentication. The request is
+// signed as it is sent, after all headers are set and the body, which may be
+// compressed, is final.
+type SigV4Transport struct {
+	Region      string
+	Service     string // Defaults to "es".
+	Credentials aws.CredentialsProvider
+	Signer      *v4.Signer        // Defaults to a signer with default options.
+	Transport   http.RoundTripper // Defaults to http.DefaultTransport.
+}
+
+// NewSigV4Transport returns a transport, that signs requests for region with
+// credentials from the default AWS credential chain, that is the environment,
+// the shared config and credentials files and the instance profile. It fails,
+// if no credentials can be resolved.
+func NewSigV4Transport(ctx context.Context, region string, next http.RoundTripper) (*SigV4Transport, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("cannot load aws config: %w", err)
+	}
+	if _, err := cfg.Credentials.Retrieve(ctx); err != nil {
+		return nil, fmt.Errorf("no aws credentials found, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, configure ~/.aws/credentials or use an instance profile: %w", err)
+	}
+	return &SigV4Transport{
+		Region:      region,
+		Credentials: cfg.Credentials,
+		Transport:   next,
+	}, nil
+}
+
+// RoundTrip signs and sends a request.
+func (t *SigV4Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The body is read for the payload hash. As any RoundTripper, this one
+	// must close it, also on errors.
+	var body []byte
+	if req.Body != nil {
+		b, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+	creds, err := t.Credentials.Retrieve(req.Context())
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve aws credentials: %w", err)
+	}
+	// Do not modify the original request, as RoundTrip must not.
+	signed := req.Clone(req.Context())
+	if req.Body != nil {
+		signed.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	signed.Header.Del("Authorization")
+	service := t.Service
+	if service == "" {
+		service = "es"
+	}
+	h := sha256.Sum256(body)
+	hash := hex.EncodeToString(h[:])
+	signed.Header.Set("X-Amz-Content-Sha256", hash)
+	signer := t.Signer
+	if signer == nil {
+		signer = v4.NewSigner()
+	}
+	if err := signer.SignHTTP(req.Context(), creds, signed, hash, service, t.Region, time.Now()); err != nil {
+		return nil, err
+	}
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return transport.RoundTrip(signed)
+}
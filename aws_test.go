@@ -0,0 +1,102 @@
+package esbulk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+// roundTripFunc turns a function into a transport.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// closeRecorder records, whether a body was closed.
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestSigV4Transport(t *testing.T) {
+	var signed *http.Request
+	var body string
+	transport := &SigV4Transport{
+		Region:      "eu-west-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "secret", "token"),
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			signed = req
+			b, err := io.ReadAll(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			body = string(b)
+			return &http.Response{StatusCode: 200, Body: http.NoBody, Request: req}, nil
+		}),
+	}
+	rc := &closeRecorder{Reader: strings.NewReader("{}\n")}
+	req, err := http.NewRequest("POST", "https://search.example.com/_bulk", rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if _, err := transport.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Header.Get("Authorization") != "" {
+		t.Errorf("original request was modified")
+	}
+	if !rc.closed {
+		t.Errorf("original request body was not closed")
+	}
+	if body != "{}\n" {
+		t.Errorf("got body %q, want %q", body, "{}\n")
+	}
+	auth := signed.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") {
+		t.Errorf("got %s, want a SigV4 authorization with the access key", auth)
+	}
+	if !strings.Contains(auth, "/eu-west-1/es/aws4_request") {
+		t.Errorf("got %s, want the es service in the scope", auth)
+	}
+	for _, h := range []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date", "x-amz-security-token"} {
+		if !strings.Contains(auth, h) {
+			t.Errorf("got %s, want %s signed", auth, h)
+		}
+	}
+	sum := sha256.Sum256([]byte("{}\n"))
+	if got, want := signed.Header.Get("X-Amz-Content-Sha256"), hex.EncodeToString(sum[:]); got != want {
+		t.Errorf("got content hash %s, want %s", got, want)
+	}
+}
+
+func TestSigV4TransportClosesBodyOnError(t *testing.T) {
+	transport := &SigV4Transport{
+		Region:      "eu-west-1",
+		Credentials: credentials.NewStaticCredentialsProvider("", "", ""),
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			t.Errorf("request sent without credentials")
+			return nil, nil
+		}),
+	}
+	rc := &closeRecorder{Reader: strings.NewReader("{}\n")}
+	req, err := http.NewRequest("POST", "https://search.example.com/_bulk", rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transport.RoundTrip(req); err == nil {
+		t.Errorf("got nil, want an error for missing credentials")
+	}
+	if !rc.closed {
+		t.Errorf("original request body was not closed")
+	}
+}
@@ -0,0 +1,53 @@
+package esbulk
+
+import (
+	"sync"
+	"time"
+)
+
+// serverCooldown is the time a server is skipped, after a connection error.
+const serverCooldown = 30 * time.Second
+
+// Balancer hands out servers in round robin order and skips servers, that
+// recently failed with a connection error. It is safe for concurrent use.
+type Balancer struct {
+	mu      sync.Mutex
+	servers []string
+	next    int
+	down    map[string]time.Time // Servers to skip until the given time.
+}
+
+// NewBalancer creates a balancer for a list of servers.
+func NewBalancer(servers []string) *Balancer {
+	return &Balancer{servers: servers, down: make(map[string]time.Time)}
+}
+
+// Next returns the next available server. If all servers are marked down,
+// the next one in order is returned anyway.
+func (b *Balancer) Next() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for i := 0; i < len(b.servers); i++ {
+		s := b.servers[(b.next+i)%len(b.servers)]
+		if now.After(b.down[s]) {
+			b.next = (b.next + i + 1) % len(b.servers)
+			return s
+		}
+	}
+	s := b.servers[b.next]
+	b.next = (b.next + 1) % len(b.servers)
+	return s
+}
+
+// MarkDown skips a server for a while.
+func (b *Balancer) MarkDown(server string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.down[server] = time.Now().Add(serverCooldown)
+}
+
+// Len returns the number of servers.
+func (b *Balancer) Len() int {
+	return len(b.servers)
+}
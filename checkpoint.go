@@ -0,0 +1,51 @@
+package esbulk
+
+import "sync"
+
+// document is a document read by Run, along with its position in the input:
+// the line number of ndjson, the element of a JSON array, the row of csv or
+// the action of bulk input, which is sent with its source line.
+type document struct {
+	doc string
+	pos int64
+}
+
+// tracker follows, which positions of the input are done, so that a load can
+// be resumed from the highest position, up to which all documents are
+// indexed, even if batches complete out of order.
+type tracker struct {
+	mu     sync.Mutex
+	next   int64          // Lowest position not yet done.
+	done   map[int64]bool // Positions done, beyond next.
+	report func(pos int64)
+}
+
+// newTracker returns a tracker, which calls report with each new checkpoint,
+// or nil, if report is nil.
+func newTracker(offset int64, report func(pos int64)) *tracker {
+	if report == nil {
+		return nil
+	}
+	return &tracker{next: offset + 1, done: make(map[int64]bool), report: report}
+}
+
+// ack marks positions as done, that is indexed, failed or skipped.
+func (t *tracker) ack(positions ...int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, pos := range positions {
+		t.done[pos] = true
+	}
+	advanced := false
+	for t.done[t.next] {
+		delete(t.done, t.next)
+		t.next++
+		advanced = true
+	}
+	if advanced {
+		t.report(t.next - 1)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// checkpoint records, how far a load got: all files before File are done,
+// and File is done up to Position, which is a line for ndjson, an element for
+// a JSON array, a row for csv or an action for bulk input.
+type checkpoint struct {
+	File     string `json:"file"`
+	Position int64  `json:"position"`
+}
+
+// checkpointer keeps the checkpoint of a load and saves it to a file, at most
+// once per second while running, and on save.
+type checkpointer struct {
+	filename string
+	mu       sync.Mutex
+	current  checkpoint
+	dirty    bool
+	saved    time.Time
+}
+
+// loadCheckpoint reads the checkpoint from a file, if it exists.
+func loadCheckpoint(filename string) (*checkpointer, error) {
+	cp := &checkpointer{filename: filename, saved: time.Now()}
+	b, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &cp.current); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %s: %v", filename, err)
+	}
+	return cp, nil
+}
+
+// resume returns the index of the file to start with and the position in it,
+// up to which it is done.
+func (cp *checkpointer) resume(filenames []string) (int, int64, error) {
+	if cp.current.File == "" {
+		return 0, 0, nil
+	}
+	for i, filename := range filenames {
+		if filename == cp.current.File {
+			return i, cp.current.Position, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("checkpoint %s refers to %s, which is not among the inputs", cp.filename, cp.current.File)
+}
+
+// set updates the checkpoint and saves it, if the last save is a second ago.
+func (cp *checkpointer) set(file string, pos int64) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.current = checkpoint{File: file, Position: pos}
+	cp.dirty = true
+	if time.Since(cp.saved) < time.Second {
+		return
+	}
+	if err := cp.write(); err != nil {
+		warnf("cannot save checkpoint: %v", err)
+	}
+}
+
+// save writes the checkpoint, if it changed since the last write.
+func (cp *checkpointer) save() error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.write()
+}
+
+// write replaces the checkpoint file atomically, so an interrupted write never
+// leaves a broken checkpoint behind.
+func (cp *checkpointer) write() error {
+	if !cp.dirty {
+		return nil
+	}
+	b, err := json.Marshal(cp.current)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(cp.filename), filepath.Base(cp.filename)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), cp.filename); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	cp.dirty, cp.saved = false, time.Now()
+	return nil
+}
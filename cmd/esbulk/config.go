@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+
+	"github.com/BurntSushi/toml"
+)
+
+// applyConfig sets flags from a TOML config file, unless they are given on
+// the command line, which takes precedence. Environment variables, like
+// ES_SERVER, override both, so the order is defaults, config file, command
+// line, environment. Keys are flag names without the dash, values are
+// strings, numbers, booleans or, for repeatable flags like server or
+// add-field, arrays of these.
+//
+//	server = ["https://es1:9200", "https://es2:9200"]
+//	index = "example"
+//	size = 5000
+//	verbose = true
+func applyConfig(fs *flag.FlagSet, filename string) error {
+	var config map[string]interface{}
+	md, err := toml.DecodeFile(filename, &config)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	// Keys are applied in the order of the file, nested keys of tables are
+	// reported with the table.
+	for _, k := range md.Keys() {
+		if len(k) > 1 {
+			continue
+		}
+		key := k[0]
+		if key == "config" || fs.Lookup(key) == nil {
+			return fmt.Errorf("%s: unknown key: %s", filename, key)
+		}
+		values, err := configValues(config[key])
+		if err != nil {
+			return fmt.Errorf("%s: %s: %v", filename, key, err)
+		}
+		if explicit[key] {
+			continue
+		}
+		for _, v := range values {
+			if err := fs.Set(key, v); err != nil {
+				return fmt.Errorf("%s: %s: %v", filename, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configValues turns a decoded TOML value or array of values into flag
+// values.
+func configValues(v interface{}) ([]string, error) {
+	if vs, ok := v.([]interface{}); ok {
+		var values []string
+		for _, v := range vs {
+			s, err := configValue(v)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	}
+	s, err := configValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return []string{s}, nil
+}
+
+// configValue turns a decoded TOML string, number or boolean into a flag
+// value.
+func configValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case map[string]interface{}:
+		return "", fmt.Errorf("tables are not supported")
+	default:
+		return "", fmt.Errorf("unsupported value: %v", v)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miku/esbulk"
+)
+
+// configFlags are the flags a config file is applied to in tests.
+type configFlags struct {
+	fs      *flag.FlagSet
+	servers esbulk.ArrayFlags
+	index   *string
+	size    *int
+	verbose *bool
+}
+
+func newConfigFlags(args ...string) (*configFlags, error) {
+	c := &configFlags{fs: flag.NewFlagSet("esbulk", flag.ContinueOnError)}
+	c.fs.SetOutput(io.Discard)
+	c.fs.Var(&c.servers, "server", "")
+	c.index = c.fs.String("index", "", "")
+	c.size = c.fs.Int("size", 1000, "")
+	c.verbose = c.fs.Bool("verbose", false, "")
+	c.fs.String("config", "", "")
+	return c, c.fs.Parse(args)
+}
+
+// writeConfig writes a config file to a temporary directory.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "esbulk.toml")
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestApplyConfig(t *testing.T) {
+	var cases = []struct {
+		about   string
+		args    []string
+		config  string
+		servers []string
+		index   string
+		size    int
+		verbose bool
+		err     string
+	}{
+		{
+			about:  "scalars",
+			config: "index = \"example\"\nsize = 5000\nverbose = true\n",
+			index:  "example", size: 5000, verbose: true,
+		},
+		{
+			about:   "array",
+			config:  `server = ["http://es1:9200", "http://es2:9200"]`,
+			servers: []string{"http://es1:9200", "http://es2:9200"},
+			size:    1000,
+		},
+		{
+			about:   "empty array",
+			config:  `server = []`,
+			size:    1000,
+			servers: nil,
+		},
+		{
+			about:  "single quotes and escapes",
+			config: "index = 'a\\b'\nserver = \"http://es1:9200/\\\"x\\\"\"",
+			index:  `a\b`, servers: []string{`http://es1:9200/"x"`}, size: 1000,
+		},
+		{
+			about:  "comments",
+			config: "# a comment\n\n  # indented\nindex = \"example\" # trailing\nsize = 10# no space\n",
+			index:  "example", size: 10,
+		},
+		{
+			about:  "hash in string",
+			config: `index = "a#b" # trailing`,
+			index:  "a#b", size: 1000,
+		},
+		{
+			about:  "command line over file",
+			args:   []string{"-index", "cli", "-server", "http://cli:9200"},
+			config: "index = \"file\"\nserver = [\"http://file:9200\"]\nsize = 5\n",
+			index:  "cli", servers: []string{"http://cli:9200"}, size: 5,
+		},
+		{
+			about:  "command line over file, with a default value",
+			args:   []string{"-size", "1000"},
+			config: "size = 5\n",
+			size:   1000,
+		},
+		{
+			about:  "multi-line string",
+			config: "index = \"\"\"\nexample\"\"\"\n",
+			index:  "example", size: 1000,
+		},
+		{about: "duplicate key", config: "index = \"a\"\nindex = \"b\"\n", err: "line 2"},
+		{about: "unknown key", config: "nope = 1\n", err: "unknown key: nope"},
+		{about: "config key", config: "config = \"other.toml\"\n", err: "unknown key: config"},
+		{about: "table", config: "[cluster]\nindex = \"example\"\n", err: "unknown key: cluster"},
+		{about: "inline table", config: "index = {name = \"example\"}\n", err: "index: tables are not supported"},
+		{about: "datetime", config: "index = 1979-05-27\n", err: "index: unsupported value"},
+		{about: "no value", config: "index\n", err: "line 1"},
+		{about: "unquoted string", config: "index = example\n", err: "line 1"},
+		{about: "unterminated string", config: "index = \"example\n", err: "line 1"},
+		{about: "invalid value", config: "size = true\n", err: "size: "},
+	}
+	for _, c := range cases {
+		flags, err := newConfigFlags(c.args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = applyConfig(flags.fs, writeConfig(t, c.config))
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: got %v, want error containing %q", c.about, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: got %v, want nil", c.about, err)
+			continue
+		}
+		if !reflect.DeepEqual([]string(flags.servers), c.servers) {
+			t.Errorf("%s: got servers %q, want %q", c.about, flags.servers, c.servers)
+		}
+		if *flags.index != c.index {
+			t.Errorf("%s: got index %q, want %q", c.about, *flags.index, c.index)
+		}
+		if *flags.size != c.size {
+			t.Errorf("%s: got size %d, want %d", c.about, *flags.size, c.size)
+		}
+		if *flags.verbose != c.verbose {
+			t.Errorf("%s: got verbose %v, want %v", c.about, *flags.verbose, c.verbose)
+		}
+	}
+}
+
+func TestApplyConfigMissingFile(t *testing.T) {
+	flags, err := newConfigFlags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(flags.fs, filepath.Join(t.TempDir(), "missing.toml")); err == nil {
+		t.Errorf("got nil, want an error for a missing file")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// decompressors wrap a reader with a decompressing reader, keyed by name.
+var decompressors = map[string]func(io.Reader) (io.ReadCloser, error){
+	"none": func(r io.Reader) (io.ReadCloser, error) {
+		return io.NopCloser(r), nil
+	},
+	"gzip": func(r io.Reader) (io.ReadCloser, error) {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		// Read all members of concatenated files, as from cat a.gz b.gz.
+		zr.Multistream(true)
+		return zr, nil
+	},
+	"bzip2": func(r io.Reader) (io.ReadCloser, error) {
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	},
+	"zstd": func(r io.Reader) (io.ReadCloser, error) {
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	},
+}
+
+// compressionFromExtension guesses the compression from a filename.
+func compressionFromExtension(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".gz", ".gzip":
+		return "gzip"
+	case ".zst", ".zstd":
+		return "zstd"
+	case ".bz2":
+		return "bzip2"
+	default:
+		return "none"
+	}
+}
+
+// magics are the first bytes of compressed streams. The bzip2 magic includes
+// the block size and the start of the first block, so that text starting with
+// BZh is not mistaken for it.
+var magics = []struct {
+	compression string
+	match       func(b []byte) bool
+	n           int
+}{
+	{"gzip", func(b []byte) bool { return b[0] == 0x1f && b[1] == 0x8b }, 2},
+	{"zstd", func(b []byte) bool { return bytes.Equal(b, []byte{0x28, 0xb5, 0x2f, 0xfd}) }, 4},
+	{"bzip2", func(b []byte) bool {
+		return bytes.HasPrefix(b, []byte("BZh")) && b[3] >= '1' && b[3] <= '9' &&
+			bytes.Equal(b[4:], []byte{0x31, 0x41, 0x59, 0x26, 0x53, 0x59})
+	}, 10},
+}
+
+// compressionFromMagic detects the compression of a stream from its first
+// bytes, without consuming them, or returns "none".
+func compressionFromMagic(r *bufio.Reader) string {
+	for _, m := range magics {
+		if b, err := r.Peek(m.n); err == nil && m.match(b) {
+			return m.compression
+		}
+	}
+	return "none"
+}
+
+// decompressReader wraps r according to the compression name, "auto" will
+// guess the compression from the filename. Without a compression, compressed
+// input is detected from its first bytes, which documents never start with,
+// so a gzip file or stream works without -z, too.
+func decompressReader(r io.Reader, compression, filename string) (io.ReadCloser, error) {
+	if compression == "auto" {
+		compression = compressionFromExtension(filename)
+	}
+	if compression == "none" {
+		br, ok := r.(*bufio.Reader)
+		if !ok {
+			br = bufio.NewReader(r)
+		}
+		r, compression = br, compressionFromMagic(br)
+	}
+	f, ok := decompressors[compression]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression: %s", compression)
+	}
+	return f(r)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miku/esbulk"
+)
+
+// gzipMember compresses s as a single gzip member.
+func gzipMember(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := io.WriteString(zw, s); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRunFileMultistreamGzip(t *testing.T) {
+	// Like cat a.ldj.gz b.ldj.gz > all.ldj.gz.
+	data := append(gzipMember(t, "{\"id\": \"a\"}\n"), gzipMember(t, "{\"id\": \"b\"}\n")...)
+	filename := filepath.Join(t.TempDir(), "all.ldj.gz")
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(b))
+		mu.Unlock()
+		io.WriteString(w, `{"took":1,"errors":false,"items":[]}`)
+	}))
+	defer srv.Close()
+	for _, compression := range []string{"gzip", "auto", "none"} {
+		bodies = nil
+		options := esbulk.Options{
+			Servers:   []string{srv.URL},
+			Index:     "x",
+			IDField:   "id",
+			BatchSize: 10,
+			Workers:   1,
+		}
+		var read int64
+		stats, err := runFile(context.Background(), options, filename, compression, &read)
+		if err != nil {
+			t.Errorf("%s: got %v, want nil", compression, err)
+			continue
+		}
+		if stats.Docs != 2 {
+			t.Errorf("%s: got %d docs, want 2", compression, stats.Docs)
+		}
+		body := strings.Join(bodies, "")
+		for _, id := range []string{`"_id":"a"`, `"_id":"b"`} {
+			if !strings.Contains(body, id) {
+				t.Errorf("%s: document %s not indexed: %q", compression, id, body)
+			}
+		}
+	}
+}
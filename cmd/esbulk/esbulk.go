@@ -2,50 +2,346 @@ package main
 
 import (
 	"bufio"
-	"compress/gzip"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"sort"
+	"strconv"
 	"strings"
-	"sync"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/miku/esbulk"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/term"
+	"golang.org/x/time/rate"
 )
 
 // Version of application.
 const Version = "0.4.13"
 
-// indexSettingsRequest runs updates an index setting, given a body and options.
-func indexSettingsRequest(body string, options esbulk.Options) (*http.Response, error) {
+// Exit codes, in addition to 0 for success and 2 for invalid flags, as
+// reported by the flag package.
+const (
+	exitError   = 1 // Fatal error or interrupted.
+	exitPartial = 3 // Indexing completed, but some documents failed.
+)
+
+const exitCodesHelp = `
+Environment:
+  ES_SERVER      server to use, overrides -server
+  ES_API_KEY     api key to use, overrides -u and -api-key
+  ES_USERNAME    basic auth username, overrides -u and -api-key, unless ES_API_KEY is set
+  ES_PASSWORD    basic auth password, used with ES_USERNAME
+  HTTP_PROXY, HTTPS_PROXY, NO_PROXY
+                 proxy configuration, if no -proxy is given
+
+Exit codes:
+  0    all documents indexed
+  1    fatal error or interrupted by signal
+  2    invalid usage
+  3    indexing completed, but some documents failed
+`
+
+// indexSettingsRequest updates index settings, given a body and options, and
+// returns an error, if elasticsearch responds with an error status.
+func indexSettingsRequest(body string, options esbulk.Options) error {
 	// body consist of the JSON document, e.g. `{"index": {"refresh_interval": "1s"}}`
 	r := strings.NewReader(body)
-	req, err := http.NewRequest("PUT", fmt.Sprintf("%s://%s:%d/%s/_settings",
-		options.Scheme, options.Host, options.Port, options.Index), r)
+	req, err := options.NewRequest("PUT", esbulk.Path(options.Index, "_settings"), r)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	// Auth handling.
-	if options.Username != "" && options.Password != "" {
-		req.SetBasicAuth(options.Username, options.Password)
+	resp, err := options.Do(req)
+	if err != nil {
+		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to apply setting %s with %s: %s", body, resp.Status, b)
+	}
+	if options.Verbose {
+		log.Printf("applied setting: %s with status %s\n", body, resp.Status)
+	}
+	return nil
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// refreshIndex refreshes the index, a data stream or the indices behind an
+// alias, so all documents are searchable.
+func refreshIndex(options esbulk.Options) error {
+	req, err := options.NewRequest("POST", esbulk.Path(options.Index, "_refresh"), nil)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	resp, err := options.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("refresh failed: %s", resp.Status)
 	}
 	if options.Verbose {
-		log.Printf("applied setting: %s with status %s\n", body, resp.Status)
+		log.Printf("index refreshed: %s\n", resp.Status)
+	}
+	return nil
+}
+
+// expandFilenames expands any glob patterns in the given arguments, other
+// arguments are used as is. A pattern matching no files is an error.
+func expandFilenames(args []string) ([]string, error) {
+	var filenames []string
+	for _, arg := range args {
+		if isURL(arg) || !strings.ContainsAny(arg, "*?[") {
+			filenames = append(filenames, arg)
+			continue
+		}
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", arg, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match pattern: %s", arg)
+		}
+		sort.Strings(matches)
+		filenames = append(filenames, matches...)
+	}
+	return filenames, nil
+}
+
+// splitFields splits a comma separated list of field names, ignoring blanks.
+func splitFields(s string) []string {
+	var fields []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// parseUser splits the value of -u into username and password. Only the
+// first colon separates them, as passwords may contain colons. Without a
+// colon, the password must come from a file.
+func parseUser(s string, passwordFile bool) (username, password string, err error) {
+	parts := strings.SplitN(s, ":", 2)
+	switch {
+	case len(parts) == 2:
+		return parts[0], parts[1], nil
+	case passwordFile:
+		return parts[0], "", nil
+	default:
+		return "", "", errors.New("http basic auth syntax is: username:password")
+	}
+}
+
+// envServers returns ES_SERVER, if set, and servers otherwise. The
+// environment takes precedence over flags and the config file.
+func envServers(servers []string) []string {
+	if v := os.Getenv("ES_SERVER"); v != "" {
+		return []string{v}
+	}
+	return servers
+}
+
+// envCredentials returns the api key or basic auth credentials from
+// ES_API_KEY or ES_USERNAME and ES_PASSWORD, if set, and the given ones
+// otherwise. Credentials from the environment replace all others, and the api
+// key wins, if both are set.
+func envCredentials(apiKey, username, password string) (string, string, string) {
+	if v := os.Getenv("ES_API_KEY"); v != "" {
+		return v, "", ""
+	}
+	if v := os.Getenv("ES_USERNAME"); v != "" {
+		return "", v, os.Getenv("ES_PASSWORD")
+	}
+	return apiKey, username, password
+}
+
+// runFiles indexes the documents of all files, use "-" for stdin, up to the
+// limit of documents in total, and returns the combined stats. If every is
+// positive, progress is logged at that interval. If m is not nil, it is kept
+// up to date. If cp is not nil, the load resumes from it and updates it.
+func runFiles(ctx context.Context, options esbulk.Options, filenames []string, compression string, every time.Duration, m *metrics, cp *checkpointer) (esbulk.Stats, error) {
+	var total esbulk.Stats
+	if cp != nil {
+		// Skip the files done and resume the last one.
+		i, offset, err := cp.resume(filenames)
+		if err != nil {
+			return total, err
+		}
+		if i > 0 {
+			log.Printf("resuming from checkpoint, skipping %d files", i)
+		}
+		if offset > 0 {
+			log.Printf("resuming %s after position %d", inputName(filenames[i]), offset)
+		}
+		filenames = filenames[i:]
+		options.Offset = offset
+	}
+	var read int64 // Input bytes read, to estimate the remaining time.
+	var p *progress
+	if every > 0 {
+		p = newProgress(inputSize(filenames), &read, every)
+		options.ProgressEvery = every
 	}
-	return resp, nil
+	if m != nil {
+		options.OnBulk = m.observe
+		if every <= 0 || every > time.Second {
+			options.ProgressEvery = time.Second
+		}
+	}
+	if options.ProgressEvery > 0 {
+		interval := options.ProgressEvery
+		options.Progress = func(s esbulk.Stats) {
+			s = addStats(total, s)
+			if m != nil {
+				m.update(s)
+			}
+			if p != nil && p.due(interval) {
+				p.log(s)
+			}
+		}
+	}
+	limit := options.Limit
+	for _, filename := range filenames {
+		if limit > 0 {
+			if total.Docs >= limit {
+				break
+			}
+			options.Limit = limit - total.Docs
+		}
+		if cp != nil {
+			filename := filename
+			options.Checkpoint = func(pos int64) { cp.set(filename, pos) }
+		}
+		stats, err := runFile(ctx, options, filename, compression, &read)
+		options.Offset = 0
+		total = addStats(total, stats)
+		if m != nil {
+			m.update(total)
+		}
+		if err == context.Canceled {
+			return total, err
+		}
+		if err != nil {
+			return total, fmt.Errorf("%s: %w", inputName(filename), err)
+		}
+	}
+	return total, nil
+}
+
+// addStats adds up the stats of two runs.
+func addStats(a, b esbulk.Stats) esbulk.Stats {
+	a.Docs += b.Docs
+	a.Unsampled += b.Unsampled
+	a.Indexed += b.Indexed
+	a.Failed += b.Failed
+	a.Bytes += b.Bytes
+	a.Batches += b.Batches
+	a.Elapsed += b.Elapsed
+	a.Workers = append([]esbulk.WorkerStats(nil), a.Workers...)
+	for _, w := range b.Workers {
+		found := false
+		for i := range a.Workers {
+			if a.Workers[i].Worker == w.Worker {
+				a.Workers[i].Indexed += w.Indexed
+				a.Workers[i].Failed += w.Failed
+				a.Workers[i].Bytes += w.Bytes
+				a.Workers[i].Batches += w.Batches
+				found = true
+			}
+		}
+		if !found {
+			a.Workers = append(a.Workers, w)
+		}
+	}
+	return a
+}
+
+func runFile(ctx context.Context, options esbulk.Options, filename, compression string, read *int64) (esbulk.Stats, error) {
+	r, err := openInput(ctx, filename, compression, read)
+	if err != nil {
+		return esbulk.Stats{}, err
+	}
+	defer r.Close()
+	return esbulk.Run(ctx, options, r)
+}
+
+// countFiles returns the number of documents in all files, without indexing
+// them.
+func countFiles(ctx context.Context, options esbulk.Options, filenames []string, compression string) (int64, error) {
+	var total, read int64
+	for _, filename := range filenames {
+		r, err := openInput(ctx, filename, compression, &read)
+		if err != nil {
+			return total, fmt.Errorf("%s: %w", inputName(filename), err)
+		}
+		n, err := esbulk.CountInput(ctx, options, r)
+		r.Close()
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("%s: %w", inputName(filename), err)
+		}
+		if options.Verbose {
+			log.Printf("%s: %d docs", inputName(filename), n)
+		}
+	}
+	return total, nil
+}
+
+// openInput opens a file, an URL or stdin, for "-", and decompresses it, if
+// needed, counting the bytes read. Closing the reader closes the input.
+func openInput(ctx context.Context, filename, compression string, read *int64) (io.ReadCloser, error) {
+	var file io.ReadCloser = io.NopCloser(os.Stdin)
+	switch {
+	case isURL(filename):
+		body, c, err := openURL(ctx, filename, compression)
+		if err != nil {
+			return nil, err
+		}
+		file, compression = body, c
+	case filename != "-":
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		file = f
+	}
+	zreader, err := decompressReader(bufio.NewReader(countingReader{r: file, n: read}), compression, filename)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return inputCloser{ReadCloser: zreader, file: file}, nil
+}
+
+// inputCloser closes the decompressor and the input.
+type inputCloser struct {
+	io.ReadCloser
+	file io.Closer
+}
+
+func (r inputCloser) Close() error {
+	r.ReadCloser.Close()
+	return r.file.Close()
 }
 
 func main() {
@@ -53,29 +349,159 @@ func main() {
 	var serverFlags esbulk.ArrayFlags
 
 	version := flag.Bool("v", false, "prints current program version")
+	configFile := flag.String("config", "", "read flags from this TOML file, with name = value pairs; precedence is defaults < this file < command line < environment")
 	cpuprofile := flag.String("cpuprofile", "", "write cpu profile to file")
 	memprofile := flag.String("memprofile", "", "write heap profile to file")
 	indexName := flag.String("index", "", "index name")
-	docType := flag.String("type", "default", "elasticsearch doc type")
-	flag.Var(&serverFlags, "server", "elasticsearch server, this works with https as well")
+	indexPattern := flag.String("index-pattern", "", `go template to compute the target index per document, like 'logs-{{.timestamp | date "2006.01.02"}}'`)
+	indexField := flag.String("index-from-field", "", "name of field with the target index of each document, like _index, documents without it go to -index-fallback or -index")
+	fallbackIndex := flag.String("index-fallback", "", "index for documents, for which -index-pattern fails or without -index-from-field, defaults to -index")
+	docType := flag.String("type", "default", "elasticsearch doc type, omitted for elasticsearch 7 and later, unless given explicitly")
+	waitForCluster := flag.Bool("wait-for-cluster", false, "wait for the cluster health to reach -wait-for-status before indexing")
+	waitForStatus := flag.String("wait-for-status", "yellow", "cluster health status to wait for, green or yellow")
+	waitTimeout := flag.Duration("wait-timeout", 60*time.Second, "maximum time to wait for the cluster")
+	distribution := flag.String("distribution", "auto", "elasticsearch, opensearch or auto to detect from the server")
+	compactActions := flag.Bool("compact-actions", false, `post to the -index bulk endpoint and send actions like {"index":{}}, without the index and type, to save bytes`)
+	typeless := flag.Bool("typeless", false, "never send a document type and skip the server version check, for elasticsearch 7 and later or opensearch")
+	esVersion := flag.String("es-version", "", "elasticsearch version, like 7 or 6.8.0, detected from the server if empty")
+	flag.Var(&serverFlags, "server", "elasticsearch server, this works with https as well, repeat or separate by comma to use multiple servers in round robin order")
+	pathPrefix := flag.String("path-prefix", "", "path to prepend to all requests, for elasticsearch behind a reverse proxy, like /elastic, same as a path in -server")
 	host := flag.String("host", "localhost", "elasticsearch host (deprecated: use -server instead)")
 	port := flag.Int("port", 9200, "elasticsearch port (deprecated: use -server instead)")
 	batchSize := flag.Int("size", 1000, "bulk batch size")
-	numWorkers := flag.Int("w", runtime.NumCPU(), "number of workers to use")
+	adaptive := flag.Bool("adaptive", false, "adapt the batch size to the cluster load, starting at -size")
+	minSize := flag.Int("min-size", 0, "smallest batch size with -adaptive, default 1")
+	maxSize := flag.Int("max-size", 0, "largest batch size with -adaptive, default ten times -size")
+	var batchBytes esbulk.ByteSize
+	flag.Var(&batchBytes, "bytes", "flush a batch when its documents exceed this size, e.g. 5MB, in addition to -size")
+	maxRequestBytes := esbulk.ByteSize(95 << 20)
+	flag.Var(&maxRequestBytes, "max-request-bytes", "flush a batch early to keep bulk requests below this size, larger documents are skipped, default 95MB, below http.max_content_length, 0 for no limit")
+	var maxLineBytes esbulk.ByteSize
+	flag.Var(&maxLineBytes, "max-line-bytes", "fail on input lines longer than this, like 16MB, or skip them with -skip-invalid, 0 to read lines of any length, the default")
+	maxRate := flag.Float64("max-rate", 0, "maximum documents per second across all workers, 0 for no limit")
+	var maxBytesPerSec esbulk.ByteSize
+	flag.Var(&maxBytesPerSec, "max-bytes-per-sec", "maximum bulk request bytes per second across all workers, e.g. 10MB, 0 for no limit")
+	numWorkers := flag.Int("w", runtime.NumCPU(), "number of workers, that is concurrent bulk requests, independent of -gomaxprocs")
+	gomaxprocs := flag.Int("gomaxprocs", 0, "number of CPUs to use, 0 for the Go default, all cores or the GOMAXPROCS environment variable")
+	queueSize := flag.Int("queue-size", 0, "documents to read ahead of the workers, 0 to only read, when a worker is ready")
+	maxIdleConnsPerHost := flag.Int("max-idle-conns-per-host", 0, "idle connections to keep open per server, defaults to the number of workers")
+	proxyURL := flag.String("proxy", "", "proxy URL for all requests, overrides HTTP_PROXY, HTTPS_PROXY and NO_PROXY")
+	maxConnsPerHost := flag.Int("max-conns-per-host", 0, "maximum number of connections per server, 0 for no limit")
 	verbose := flag.Bool("verbose", false, "output basic progress")
-	gzipped := flag.Bool("z", false, "unzip gz'd file on the fly")
+	gzipped := flag.Bool("z", false, "unzip gz'd file on the fly, same as -decompress gzip")
+	compression := flag.String("decompress", "none", "decompress input on the fly: none, gzip, bzip2, zstd or auto, to guess from the file extension, compressed input is detected with none and auto, too")
 	mapping := flag.String("mapping", "", "mapping string or filename to apply before indexing")
+	mappingsFile := flag.String("mappings-file", "", "file with the mappings to apply before indexing, combined with -settings-file, if the index is created")
+	settingsFile := flag.String("settings-file", "", "file with index settings, used to create the index or, for an existing index, to update its dynamic settings")
+	templateName := flag.String("template", "", "name of a composable index template to put before creating the index, requires -template-file")
+	templateFile := flag.String("template-file", "", "file with the index template body for -template")
+	dataStream := flag.Bool("data-stream", false, "the -index is a data stream: use create actions and leave the settings of the backing indices alone")
+	createDataStream := flag.Bool("create-data-stream", false, "create the -data-stream before indexing, if it does not exist, requires a matching index template")
+	templateAutoCreate := flag.Bool("template-auto-create", false, "do not create the index, let elasticsearch create it from the -template, if it does not exist")
+	sample := flag.Float64("sample", 0, "index only this fraction of documents, picked at random, like 0.05 for 5%")
+	seed := flag.Int64("seed", 0, "random seed for -sample, for a reproducible sample")
+	progressEvery := flag.Duration("progress", 0, "log progress at this interval, like 10s")
+	statsJSON := flag.Bool("stats-json", false, "write stats as JSON to stdout at completion")
+	statsFile := flag.String("stats-file", "", "write stats as JSON to this file at completion")
+	logFormat := flag.String("log-format", "text", "log format, text or json")
+	logLevel := flag.String("log-level", "info", "minimum log level: debug, info, warn or error")
+	metricsAddr := flag.String("metrics-addr", "", "serve prometheus metrics on this address under /metrics, like :2112")
+	limit := flag.Int64("limit", 0, "stop after this many documents, 0 for no limit")
+	inputFormat := flag.String("input-format", "ndjson", "input format: ndjson, one document per line, json-array, csv, tsv or bulk, pairs of action and source lines")
+	rawBulk := flag.Bool("raw-bulk", false, "input is in bulk format, with action and source lines, which are sent as is, same as -input-format bulk")
+	delimiter := flag.String("delimiter", "", "field delimiter for csv input, a single character, defaults to comma, or tab for tsv")
+	noHeader := flag.Bool("no-header", false, "csv input has no header row, field names are taken from -columns")
+	columns := flag.String("columns", "", "comma separated field names for csv input, required with -no-header")
+	csvTyped := flag.Bool("csv-typed", false, "convert numbers and booleans in csv input, instead of using strings")
+	allowComments := flag.Bool("allow-comments", false, "ignore lines starting with #")
+	skipInvalid := flag.Bool("skip-invalid", false, "skip and count lines, that are not valid JSON, instead of exiting")
+	validate := flag.Bool("validate", false, "check that each line is valid JSON, before sending it, and exit at the first invalid line, implied by -skip-invalid")
+	checkpointFile := flag.String("checkpoint", "", "record progress in this file and resume from it on restart, input must only be appended to between runs")
+	countOnly := flag.Bool("count-only", false, "only count the documents in the input, print the count and exit, without connecting to elasticsearch")
+	dryRun := flag.Bool("dry-run", false, "parse documents and build bulk requests, but do not index or change anything")
+	alias := flag.String("alias", "", "add this alias to the index after a successful load")
+	aliasSwap := flag.Bool("alias-swap", false, "remove the -alias from all other indices at the same time")
+	skipExisting := flag.Bool("skip-existing", false, "exit with an error, if the index already exists and is not empty, to prevent loading twice")
+	createOnly := flag.Bool("create-only", false, "exit with an error, if the index does not exist, instead of creating it")
 	purge := flag.Bool("purge", false, "purge any existing index before indexing")
 	idfield := flag.String("id", "", "name of field to use as id field, by default ids are autogenerated")
-	user := flag.String("u", "", "http basic auth username:password, like curl -u")
+	idTemplate := flag.String("id-template", "", "go template to generate ids from documents, like '{{.tenant}}-{{.sku}}'")
+	actionTemplate := flag.String("action-template", "", `go template to generate the action metadata of each document, like '{"_id": {{json .id}}, "routing": {{json .tenant}}}', replaces -id, -routing and -version-field`)
+	idHash := flag.Bool("id-hash", false, "use the SHA-1 of the document content as id, so retries and reruns do not create duplicates")
+	skipMissingID := flag.Bool("skip-missing-id", false, "skip documents, for which no id can be found or generated, instead of failing")
+	var headerFlags esbulk.ArrayFlags
+	flag.Var(&headerFlags, "header", "extra HTTP header for all requests to elasticsearch, 'Name: value', repeatable")
+	var addFieldFlags esbulk.ArrayFlags
+	flag.Var(&addFieldFlags, "add-field", "add a constant field to every document, name=value, repeatable")
+	var renameFlags esbulk.ArrayFlags
+	flag.Var(&renameFlags, "rename", "rename a field, old=new, in nested objects, too, repeatable")
+	fieldCase := flag.String("field-case", "", "convert field names to lower or snake case, like FooBar to foobar or foo_bar, except for -rename fields")
+	dropFields := flag.String("drop-fields", "", "comma separated fields not to index, nested fields as dotted paths, like a,b.c")
+	keepFields := flag.String("keep-fields", "", "comma separated fields to index, all others are dropped, nested fields as dotted paths, like x,y.z")
+	fieldDepth := flag.Int("field-depth", 0, "levels of nested objects, whose fields -rename and -field-case change, 0 for all")
+	timestampField := flag.String("add-timestamp", "", "add the current time in RFC3339 format as a field with this name to every document")
+	overwriteFields := flag.Bool("overwrite-fields", false, "let -add-field and -add-timestamp overwrite existing fields")
+	opType := flag.String("op-type", "index", "bulk action to use: index, create, which fails for existing ids, update, with -id, or delete, with ids as input")
+	docAsUpsert := flag.Bool("doc-as-upsert", true, "with -op-type update, insert documents, that do not exist yet")
+	flag.StringVar(opType, "action", "index", "same as -op-type")
+	routing := flag.String("routing", "", "constant routing value for all documents")
+	routingField := flag.String("routing-field", "", "name of field to use as routing, falls back to -routing for documents without it")
+	joinParentField := flag.String("join-parent-field", "", "field with the parent id of child documents, like my_join.parent, used as routing")
+	routingRequired := flag.Bool("routing-required", false, "fail on documents without the -routing-field")
+	versionField := flag.String("version-field", "", "name of field to use as external document version")
+	versionType := flag.String("version-type", "external", "version type to use with -version-field: external or external_gte")
+	versionRequired := flag.Bool("version-required", false, "fail on documents without a version field, instead of indexing them without version")
+	user := flag.String("u", "", "http basic auth username:password, like curl -u, use username:- to read the password from stdin")
+	passwordFile := flag.String("password-file", "", "read the basic auth password for -u from a file")
+	awsRegion := flag.String("aws-region", "", "sign requests with AWS SigV4 for this region, e.g. for Amazon OpenSearch Service, replaces basic auth")
+	apiKey := flag.String("api-key", "", "api key for authorization, base64 encoded id:api_key, as returned by the create api key api")
+	caCert := flag.String("cacert", "", "PEM encoded CA certificates to verify the server with, defaults to SSL_CERT_FILE")
+	clientCert := flag.String("cert", "", "PEM encoded client certificate for mutual TLS")
+	clientKey := flag.String("key", "", "PEM encoded client key for mutual TLS")
+	insecure := flag.Bool("insecure", false, "skip TLS certificate verification, for testing only")
+	flag.BoolVar(insecure, "k", false, "same as -insecure")
 	zeroReplica := flag.Bool("0", false, "set the number of replicas to 0 during indexing")
+	flag.BoolVar(zeroReplica, "zero-replicas-during-load", false, "same as -0, the number of replicas is restored afterwards")
+	shards := flag.Int("shards", 0, "number of shards, if the index is created, 0 for the cluster default")
+	replicas := flag.Int("replicas", -1, "number of replicas, if the index is created, -1 for the cluster default")
+	noSettingsTweak := flag.Bool("no-settings-tweak", false, "do not change refresh_interval or number_of_replicas and do not flush the index, e.g. for managed or shared indices")
+	forcemerge := flag.Int("forcemerge", 0, "force merge the index to at most this many segments after a complete load, 0 to skip")
+	rolloverMaxDocs := flag.Int64("rollover-max-docs", 0, "roll the -index alias or data stream over to a new index, when its write index has this many documents, checked every -rollover-every")
+	rolloverEvery := flag.Duration("rollover-every", 10*time.Second, "how often to check the -rollover-max-docs condition during the load")
+	forcemergeTimeout := flag.Duration("forcemerge-timeout", time.Hour, "timeout for -forcemerge, 0 for no timeout")
+	bulkRefresh := flag.String("bulk-refresh", "false", "refresh parameter of each bulk request: false, true or wait_for, to make each batch searchable before the next")
+	refresh := flag.Bool("refresh", true, "refresh the index after indexing, so all documents are searchable when esbulk exits")
+	refreshAfter := flag.String("refresh-interval", "", "refresh_interval to set after indexing, like 30s, defaults to the previous value")
+	replicasAfter := flag.Int("replicas-after", -1, "number of replicas to set after indexing, -1 to restore the previous value")
+	retries := flag.Int("retries", 0, "number of retries for bulk requests failing with 429, 502, 503, 504, connection errors or timeouts; retried timeouts may duplicate documents without an id, see -id-hash")
+	timeout := flag.Duration("timeout", 60*time.Second, "timeout for each request, timed out bulk requests are retried with -retries, which may duplicate documents without an id, 0 for no timeout")
+	retryMaxWait := flag.Duration("retry-max-wait", 30*time.Second, "maximum wait time between retries")
+	failFast := flag.Bool("fail-fast", false, "exit on the first document, that fails to index")
+	pipeline := flag.String("pipeline", "", "ingest pipeline to use for indexing")
+	requestGzip := flag.Bool("request-gzip", false, "gzip compress bulk request bodies, requires http.compression on the server")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprint(flag.CommandLine.Output(), exitCodesHelp)
+	}
 
 	flag.Parse()
 
+	if *configFile != "" {
+		if err := applyConfig(flag.CommandLine, *configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := setupLogging(*logFormat, *logLevel); err != nil {
+		log.Fatal(err)
+	}
+
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 		pprof.StartCPUProfile(f)
 		defer pprof.StopCPUProfile()
@@ -86,235 +512,1006 @@ func main() {
 		os.Exit(0)
 	}
 
-	if *indexName == "" {
-		log.Fatal("index name required")
+	if *actionTemplate != "" && (*idfield != "" || *idTemplate != "" || *idHash || *routing != "" || *routingField != "" ||
+		*joinParentField != "" || *versionField != "" || *indexPattern != "" || *indexField != "") {
+		fatal("-action-template cannot be combined with -id, -id-template, -id-hash, -routing, -routing-field, -join-parent-field, -version-field, -index-pattern or -index-from-field")
+	}
+	if *idHash && (*idfield != "" || *idTemplate != "") {
+		fatal("-id-hash cannot be combined with -id or -id-template")
+	}
+	if *opType == "update" && *idfield == "" && *idTemplate == "" && !*idHash && *actionTemplate == "" {
+		fatal("-op-type update requires -id, -id-template or -id-hash")
+	}
+	if *createDataStream && !*dataStream {
+		fatal("-create-data-stream requires -data-stream")
+	}
+	if *dataStream {
+		// Data streams are append only and only accept create actions.
+		if *opType != "index" && *opType != "create" {
+			fatalf("-data-stream cannot be combined with -op-type %s", *opType)
+		}
+		*opType = "create"
+		if *purge || *mapping != "" || *mappingsFile != "" || *settingsFile != "" || *shards > 0 || *replicas >= 0 {
+			fatal("-data-stream cannot be combined with -purge, -mapping, -mappings-file, -settings-file, -shards or -replicas, use an index template")
+		}
+		if *zeroReplica || *replicasAfter >= 0 || *refreshAfter != "" {
+			fatal("-data-stream cannot be combined with -0, -replicas-after or -refresh-interval")
+		}
+	}
+	if *rolloverMaxDocs < 0 {
+		fatal("-rollover-max-docs must not be negative")
+	}
+	if *rolloverMaxDocs > 0 {
+		// New indices are created by elasticsearch, from an index template,
+		// so like for data streams, settings are not touched.
+		if *rolloverEvery <= 0 {
+			fatal("-rollover-every must be positive")
+		}
+		if *purge || *mapping != "" || *mappingsFile != "" || *settingsFile != "" || *shards > 0 || *replicas >= 0 {
+			fatal("-rollover-max-docs cannot be combined with -purge, -mapping, -mappings-file, -settings-file, -shards or -replicas, use an index template")
+		}
+		if *zeroReplica || *replicasAfter >= 0 || *refreshAfter != "" {
+			fatal("-rollover-max-docs cannot be combined with -0, -replicas-after or -refresh-interval")
+		}
+		if *alias != "" || *indexPattern != "" || *indexField != "" {
+			fatal("-rollover-max-docs cannot be combined with -alias, -index-pattern or -index-from-field, the -index must be the alias to roll over")
+		}
+	}
+	if *opType == "create" && *idfield == "" && *idTemplate == "" && !*idHash && !*dataStream && *actionTemplate == "" {
+		warnf("-op-type create without -id behaves like index")
+	}
+
+	switch *waitForStatus {
+	case "green", "yellow":
+	default:
+		fatalf("unknown cluster status: %s", *waitForStatus)
+	}
+
+	switch *distribution {
+	case "auto", "elasticsearch", "opensearch":
+	default:
+		fatalf("unknown distribution: %s", *distribution)
+	}
+
+	if (*templateName == "") != (*templateFile == "") {
+		fatal("-template and -template-file must be used together")
+	}
+	if *joinParentField != "" && (*routingField != "" || *routingRequired) {
+		fatal("-join-parent-field cannot be combined with -routing-field or -routing-required")
+	}
+	if *routingRequired && *routingField == "" {
+		fatal("-routing-required requires -routing-field")
+	}
+	if *forcemerge < 0 {
+		fatal("-forcemerge must not be negative")
+	}
+	if *noSettingsTweak && (*zeroReplica || *replicasAfter >= 0 || *refreshAfter != "") {
+		fatal("-no-settings-tweak cannot be combined with -0, -replicas-after or -refresh-interval")
+	}
+	if *purge && (*skipExisting || *createOnly) {
+		fatal("-purge cannot be combined with -skip-existing or -create-only")
+	}
+	if *aliasSwap && *alias == "" {
+		fatal("-alias-swap requires -alias")
+	}
+	if *templateAutoCreate && *templateName == "" {
+		fatal("-template-auto-create requires -template")
+	}
+	if *templateAutoCreate && (*mapping != "" || *mappingsFile != "" || *settingsFile != "") {
+		fatal("-template-auto-create cannot be combined with -mapping, -mappings-file or -settings-file, put them into the template")
+	}
+	if *indexField != "" && *indexPattern != "" {
+		fatal("-index-from-field and -index-pattern are mutually exclusive")
+	}
+	if *mapping != "" && *mappingsFile != "" {
+		fatal("-mapping and -mappings-file are mutually exclusive")
+	}
+
+	if *rawBulk {
+		if *inputFormat != "ndjson" && *inputFormat != "bulk" {
+			fatalf("-raw-bulk conflicts with -input-format %s", *inputFormat)
+		}
+		*inputFormat = "bulk"
+	}
+
+	if *noHeader != (*columns != "") {
+		fatal("-no-header and -columns must be used together")
+	}
+
+	if *gzipped {
+		if *compression != "none" && *compression != "gzip" {
+			fatalf("-z conflicts with -decompress %s", *compression)
+		}
+		*compression = "gzip"
+	}
+	if _, ok := decompressors[*compression]; !ok && *compression != "auto" {
+		fatalf("unknown compression: %s", *compression)
 	}
 
+	serverFlags = envServers(serverFlags)
 	if len(serverFlags) == 0 {
 		serverFlags = append(serverFlags, "http://localhost:9200")
 	}
+	// Servers may be given as a comma separated list, too.
+	var servers []string
+	for _, v := range serverFlags {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				servers = append(servers, s)
+			}
+		}
+	}
+	serverFlags = servers
 
 	if *verbose {
 		log.Printf("using %d servers", len(serverFlags))
 	}
 
-	var file io.Reader = os.Stdin
+	filenames, err := expandFilenames(flag.Args())
+	if err != nil {
+		fatal(err)
+	}
+	if len(filenames) == 0 {
+		// Without a filename, only read from stdin, if it is not a terminal.
+		if term.IsTerminal(int(os.Stdin.Fd())) {
+			fatal("no input: pass a filename or use - to read from stdin")
+		}
+		filenames = []string{"-"}
+	}
+	var cp *checkpointer
+	if *checkpointFile != "" {
+		for _, filename := range filenames {
+			if filename == "-" {
+				fatal("-checkpoint cannot be used with stdin, the input must be a file")
+			}
+		}
+		if cp, err = loadCheckpoint(*checkpointFile); err != nil {
+			fatal(err)
+		}
+	}
+
+	// Workers mostly wait for elasticsearch, so their number does not limit
+	// the CPUs used for parsing and encoding.
+	if *gomaxprocs > 0 {
+		runtime.GOMAXPROCS(*gomaxprocs)
+	}
+
+	options := esbulk.Options{
+		Servers:         serverFlags,
+		Host:            *host,
+		Port:            *port,
+		Index:           *indexName,
+		DocType:         *docType,
+		Typeless:        *typeless,
+		CompactActions:  *compactActions,
+		BatchSize:       *batchSize,
+		Verbose:         *verbose,
+		Scheme:          "http",
+		IDField:         *idfield,
+		IDHash:          *idHash,
+		Retries:         *retries,
+		RetryMaxWait:    *retryMaxWait,
+		FailFast:        *failFast,
+		Pipeline:        *pipeline,
+		BulkRefresh:     *bulkRefresh,
+		RequestGzip:     *requestGzip,
+		BatchBytes:      int64(batchBytes),
+		MaxRequestBytes: int64(maxRequestBytes),
+		MaxLineBytes:    int64(maxLineBytes),
+		Adaptive:        *adaptive,
+		MinBatchSize:    *minSize,
+		MaxBatchSize:    *maxSize,
+		OpType:          *opType,
+		DocAsUpsert:     *docAsUpsert,
+		Routing:         *routing,
+		RoutingField:    *routingField,
+		RoutingRequired: *routingRequired,
+		JoinParentField: *joinParentField,
+		VersionField:    *versionField,
+		VersionType:     *versionType,
+		VersionRequired: *versionRequired,
+		SkipMissingID:   *skipMissingID,
+		TimestampField:  *timestampField,
+		OverwriteFields: *overwriteFields,
+		IndexField:      *indexField,
+		FallbackIndex:   *fallbackIndex,
+		Timeout:         *timeout,
+		DryRun:          *dryRun,
+		SkipInvalid:     *skipInvalid,
+		ValidateJSON:    *validate,
+		AllowComments:   *allowComments,
+		InputFormat:     *inputFormat,
+		CSVTyped:        *csvTyped,
+		Limit:           *limit,
+		Sample:          *sample,
+		Workers:         *numWorkers,
+		QueueSize:       *queueSize,
+	}
+
+	if *delimiter != "" {
+		d := []rune(strings.Replace(*delimiter, `\t`, "\t", 1))
+		if len(d) != 1 {
+			fatalf("-delimiter must be a single character, got %q", *delimiter)
+		}
+		options.CSVDelimiter = d[0]
+	}
+	if *columns != "" {
+		options.CSVColumns = strings.Split(*columns, ",")
+	}
 
-	if flag.NArg() > 0 {
-		f, err := os.Open(flag.Arg(0))
+	// Only count the input, before anything needs a server or an index.
+	if *countOnly {
+		n, err := countFiles(context.Background(), options, filenames, *compression)
 		if err != nil {
-			log.Fatalln(err)
+			fatal(err)
 		}
-		defer f.Close()
-		file = f
+		fmt.Println(n)
+		os.Exit(0)
+	}
+
+	// backwards-compat for -host and -port, only use newer -server flag if
+	// older -host and -port are on defaults
+	hostPortSet := *host != "localhost" || *port != 9200
+	if hostPortSet {
+		options.Servers = []string{fmt.Sprintf("%s://%s", options.Scheme, net.JoinHostPort(*host, strconv.Itoa(*port)))}
+	}
+	// All requests are built by appending the path to a server URL, so a
+	// prefix only needs to be added to the servers.
+	if p := strings.Trim(*pathPrefix, "/"); p != "" {
+		for i, server := range options.Servers {
+			u, err := url.Parse(server)
+			if err != nil {
+				fatalf("invalid server %s: %v", server, err)
+			}
+			if strings.Trim(u.Path, "/") != "" {
+				fatalf("-path-prefix cannot be combined with a path in -server %s", server)
+			}
+			options.Servers[i] = strings.TrimRight(server, "/") + "/" + p
+		}
+	}
+	var deprecated []string
+	var serverSet bool
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "host", "port":
+			deprecated = append(deprecated, "-"+f.Name)
+		case "server":
+			serverSet = true
+		}
+	})
+	if len(deprecated) > 0 {
+		dep, is := strings.Join(deprecated, " and "), "is"
+		if len(deprecated) > 1 {
+			is = "are"
+		}
+		warnf("%s %s deprecated, use -server %s://%s instead", dep, is, options.Scheme, net.JoinHostPort(*host, strconv.Itoa(*port)))
+		if hostPortSet && serverSet {
+			warnf("-server is ignored, since %s %s not the default", dep, is)
+		}
+	}
+	if err := options.Validate(); err != nil {
+		fatal(err)
 	}
 
-	runtime.GOMAXPROCS(*numWorkers)
+	// Set up the transport and credentials after validating the options,
+	// so a missing index is reported before a password prompt. All requests
+	// go through a single, shared transport.
+	tc, err := tlsConfig(*caCert, *clientCert, *clientKey, *insecure)
+	if err != nil {
+		fatal(err)
+	}
+	if *insecure {
+		warnf("TLS certificate verification disabled (-insecure), do not use in production")
+	}
+	idleConns := *maxIdleConnsPerHost
+	if idleConns <= 0 {
+		idleConns = *numWorkers
+	}
+	var proxy *url.URL
+	if *proxyURL != "" {
+		if proxy, err = url.Parse(*proxyURL); err != nil {
+			fatalf("invalid proxy: %v", err)
+		}
+	}
+	var transport http.RoundTripper = newTransport(tc, proxy, idleConns, *maxConnsPerHost, len(serverFlags))
+
+	if *user != "" && *apiKey != "" {
+		fatal("-u and -api-key are mutually exclusive")
+	}
+
+	// Sign all requests, after any other transport setup, so the signature
+	// covers the final request.
+	if *awsRegion != "" {
+		if *user != "" || *apiKey != "" || *passwordFile != "" {
+			fatal("-aws-region cannot be combined with -u, -password-file or -api-key")
+		}
+		signer, err := esbulk.NewSigV4Transport(context.Background(), *awsRegion, transport)
+		if err != nil {
+			fatal(err)
+		}
+		transport = signer
+	}
 
 	var username, password string
 	if len(*user) > 0 {
-		parts := strings.Split(*user, ":")
-		if len(parts) != 2 {
-			log.Fatal("http basic auth syntax is: username:password")
+		if username, password, err = parseUser(*user, *passwordFile != ""); err != nil {
+			fatal(err)
 		}
-		username = parts[0]
-		password = parts[1]
 	}
 
-	options := esbulk.Options{
-		Servers:   serverFlags,
-		Host:      *host,
-		Port:      *port,
-		Index:     *indexName,
-		DocType:   *docType,
-		BatchSize: *batchSize,
-		Verbose:   *verbose,
-		Scheme:    "http",
-		IDField:   *idfield,
-		Username:  username,
-		Password:  password,
+	// Read the password from a file or stdin, to keep it out of argv.
+	switch {
+	case *passwordFile != "":
+		if password != "" {
+			fatal("-password-file cannot be used with a password in -u")
+		}
+		if password, err = readPasswordFile(*passwordFile); err != nil {
+			fatal(err)
+		}
+	case password == "-":
+		for _, filename := range filenames {
+			if filename == "-" {
+				fatal("cannot read both password and documents from stdin")
+			}
+		}
+		if password, err = readPasswordStdin(); err != nil {
+			fatal(err)
+		}
 	}
 
-	// backwards-compat for -host and -port, only use newer -server flag if
-	// older -host and -port are on defaults
-	if *host == "localhost" && *port == 9200 {
-		if err := options.SetServer(serverFlags[0]); err != nil {
-			log.Fatal(err)
+	// Credentials from the environment override flags and the config file,
+	// unless requests are signed for AWS.
+	if *awsRegion == "" {
+		*apiKey, username, password = envCredentials(*apiKey, username, password)
+	}
+	options.Username, options.Password, options.APIKey = username, password, *apiKey
+	options.HTTPClient = &http.Client{Transport: transport}
+
+	if err := options.SetServer(options.Servers[0]); err != nil {
+		fatal(err)
+	}
+	options.Balancer = esbulk.NewBalancer(options.Servers)
+
+	if *indexPattern != "" {
+		t, err := template.New("index").Funcs(esbulk.TemplateFuncs).Option("missingkey=error").Parse(*indexPattern)
+		if err != nil {
+			fatal(err)
 		}
+		options.IndexTemplate = t
 	}
 
-	if *verbose {
-		log.Println(options)
+	if *maxRate < 0 || maxBytesPerSec < 0 {
+		fatal("-max-rate and -max-bytes-per-sec must not be negative")
+	}
+	// The limiters are shared by all workers, up to one second worth of
+	// documents or bytes may pass at once, after a pause.
+	if *maxRate > 0 {
+		options.DocLimiter = rate.NewLimiter(rate.Limit(*maxRate), int(math.Ceil(*maxRate)))
+	}
+	if maxBytesPerSec > 0 {
+		options.ByteLimiter = rate.NewLimiter(rate.Limit(maxBytesPerSec), int(maxBytesPerSec))
 	}
 
-	if *purge {
-		if err := esbulk.DeleteIndex(options); err != nil {
-			log.Fatal(err)
+	if len(headerFlags) > 0 {
+		options.Headers = make(http.Header)
+		for _, h := range headerFlags {
+			parts := strings.SplitN(h, ":", 2)
+			if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+				fatalf("-header syntax is: 'Name: value', got %s", h)
+			}
+			options.Headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
 		}
-		time.Sleep(5 * time.Second)
 	}
 
-	// create index if not exists
-	if err := esbulk.CreateIndex(options); err != nil {
-		log.Fatal(err)
+	if len(addFieldFlags) > 0 {
+		options.AddFields = make(map[string]string)
+		for _, f := range addFieldFlags {
+			parts := strings.SplitN(f, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				fatalf("-add-field syntax is: name=value, got %s", f)
+			}
+			options.AddFields[parts[0]] = parts[1]
+		}
 	}
 
-	if *mapping != "" {
-		var reader io.Reader
-		if _, err := os.Stat(*mapping); os.IsNotExist(err) {
-			reader = strings.NewReader(*mapping)
-		} else {
-			file, err := os.Open(*mapping)
-			if err != nil {
-				log.Fatal(err)
+	if len(renameFlags) > 0 {
+		options.RenameFields = make(map[string]string)
+		for _, f := range renameFlags {
+			parts := strings.SplitN(f, "=", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				fatalf("-rename syntax is: old=new, got %s", f)
 			}
-			reader = bufio.NewReader(file)
+			options.RenameFields[parts[0]] = parts[1]
+		}
+	}
+	options.FieldCase = *fieldCase
+	if *dropFields != "" && *keepFields != "" {
+		fatal("-drop-fields and -keep-fields are mutually exclusive")
+	}
+	options.DropFields = splitFields(*dropFields)
+	options.KeepFields = splitFields(*keepFields)
+	options.FieldDepth = *fieldDepth
+
+	if *idTemplate != "" {
+		if *idfield != "" {
+			fatal("-id and -id-template are mutually exclusive")
 		}
-		err := esbulk.PutMapping(options, reader)
+		t, err := template.New("id").Funcs(esbulk.TemplateFuncs).Option("missingkey=error").Parse(*idTemplate)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
+		options.IDTemplate = t
 	}
 
-	queue := make(chan string)
-	var wg sync.WaitGroup
-
-	for i := 0; i < *numWorkers; i++ {
-		wg.Add(1)
-		go esbulk.Worker(fmt.Sprintf("worker-%d", i), options, queue, &wg)
+	if *actionTemplate != "" {
+		t, err := template.New("action").Funcs(esbulk.TemplateFuncs).Option("missingkey=error").Parse(*actionTemplate)
+		if err != nil {
+			fatal(err)
+		}
+		options.ActionTemplate = t
 	}
 
-	client := &http.Client{}
+	if *seed != 0 {
+		options.Rand = rand.New(rand.NewSource(*seed))
+	}
 
-	// Store number_of_replicas settings for restoration later.
-	link := fmt.Sprintf("%s://%s:%d/%s/_settings", options.Scheme, options.Host, options.Port, options.Index)
-	resp, err := http.Get(link)
-	if err != nil {
-		log.Fatal(err)
+	if *shards > 0 || *replicas >= 0 {
+		options.IndexSettings = make(map[string]interface{})
+		if *shards > 0 {
+			options.IndexSettings["number_of_shards"] = *shards
+		}
+		if *replicas >= 0 {
+			options.IndexSettings["number_of_replicas"] = *replicas
+		}
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		log.Fatalf("could not get settings: %s", link)
+
+	// Wait for a cluster that might still be starting, before sending any
+	// other requests.
+	if *waitForCluster {
+		if err := esbulk.WaitForCluster(options, *waitForStatus, *waitTimeout); err != nil {
+			fatal(err)
+		}
 	}
 
-	doc := make(map[string]interface{})
-	dec := json.NewDecoder(resp.Body)
-	if err := dec.Decode(&doc); err != nil {
-		log.Fatal(err)
+	// Document types were removed in Elasticsearch 7 and are not supported by
+	// OpenSearch at all, only send one, if the server is an older
+	// Elasticsearch or the type was requested explicitly. With -typeless, the
+	// server is not asked, which may need extra permissions.
+	var typeFlagSet bool
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "type" {
+			typeFlagSet = true
+		}
+	})
+	v, dist := *esVersion, *distribution
+	if *typeless {
+		if typeFlagSet {
+			warnf("-typeless given, ignoring -type")
+		}
+		options.DocType = ""
+	} else if dist == "auto" || (dist == "elasticsearch" && v == "" && !typeFlagSet) {
+		number, d, err := esbulk.ServerVersion(options)
+		if err != nil {
+			warnf("cannot detect server version, use -es-version or -distribution: %v", err)
+		} else {
+			if v == "" {
+				v = number
+			}
+			if dist == "auto" {
+				dist = d
+			}
+		}
+	}
+	if *verbose && v != "" {
+		log.Printf("%s version %s", dist, v)
 	}
-	// Example response.
-	// {
-	// 	"ai": {
-	// 	  "settings": {
-	// 		"index": {
-	// 		  "refresh_interval": "1s",
-	// 		  "number_of_shards": "5",
-	// 		  "provided_name": "ai",
-	// 		  "creation_date": "1523372145102",
-	// 		  "number_of_replicas": "1",
-	// 		  "uuid": "5k-id0OZTKKU4A7DeeUNdQ",
-	// 		  "version": {
-	// 			"created": "6020399"
-	// 		  }
-	// 		}
-	// 	  }
-	// 	}
-	// }
-
-	// TODO(miku): Rework this.
-	numberOfReplicas := doc[options.Index].(map[string]interface{})["settings"].(map[string]interface{})["index"].(map[string]interface{})["number_of_replicas"]
+	switch {
+	case *typeless:
+	case dist == "opensearch":
+		if typeFlagSet {
+			warnf("opensearch does not support document types, ignoring -type")
+		}
+		options.DocType = ""
+	case !typeFlagSet && v != "":
+		major, err := esbulk.MajorVersion(v)
+		if err != nil {
+			fatal(err)
+		}
+		if major >= 7 {
+			options.DocType = ""
+		}
+	}
+
 	if *verbose {
-		log.Printf("on shutdown, number_of_replicas will be set back to %s", numberOfReplicas)
+		log.Println(options)
 	}
 
-	// Shutdown procedure. TODO(miku): Handle signals, too.
-	defer func() {
-		// Realtime search.
-		if _, err := indexSettingsRequest(`{"index": {"refresh_interval": "1s"}}`, options); err != nil {
-			log.Fatal(err)
+	// Guard against loading into the wrong index, before anything is changed.
+	if *skipExisting || *createOnly {
+		exists, err := esbulk.IndexExists(options)
+		if err != nil {
+			fatal(err)
 		}
-		// Reset number of replicas.
-		if _, err := indexSettingsRequest(fmt.Sprintf(`{"index": {"number_of_replicas": %q}}`, numberOfReplicas), options); err != nil {
-			log.Fatal(err)
+		if *createOnly && !exists {
+			fatalf("index %s does not exist, not creating it with -create-only", options.Index)
+		}
+		if *skipExisting && exists {
+			n, err := esbulk.CountDocuments(options)
+			if err != nil {
+				fatal(err)
+			}
+			if n > 0 {
+				fatalf("index %s already has %d documents, not loading into it with -skip-existing", options.Index, n)
+			}
 		}
+	}
 
-		// Persist documents.
-		link := fmt.Sprintf("%s://%s:%d/%s/_flush", options.Scheme, options.Host, options.Port, options.Index)
-		req, err := http.NewRequest("POST", link, nil)
-		if err != nil {
-			log.Fatal(err)
+	// Only read from the cluster, parse documents and build batches.
+	if *dryRun {
+		exists, err := esbulk.IndexExists(options)
+		switch {
+		case *dataStream:
+			if *createDataStream {
+				log.Printf("dry run: data stream %s would be created, if it does not exist", options.Index)
+			}
+		case err != nil:
+			log.Printf("dry run: %v", err)
+		case exists && *purge:
+			log.Printf("dry run: index %s exists and would be purged", options.Index)
+		case exists:
+			log.Printf("dry run: index %s exists", options.Index)
+		default:
+			log.Printf("dry run: index %s would be created", options.Index)
+		}
+		if *templateName != "" {
+			log.Printf("dry run: index template %s would be applied", *templateName)
 		}
-		if options.Username != "" && options.Password != "" {
-			req.SetBasicAuth(options.Username, options.Password)
+		if *mapping != "" || *mappingsFile != "" {
+			log.Printf("dry run: mapping would be applied")
 		}
-		req.Header.Set("Content-Type", "application/json")
-		resp, err := client.Do(req)
+		if *settingsFile != "" {
+			log.Printf("dry run: settings would be applied")
+		}
+		if *rolloverMaxDocs > 0 {
+			log.Printf("dry run: %s would be rolled over at %d docs", options.Index, *rolloverMaxDocs)
+		}
+		if *forcemerge > 0 {
+			log.Printf("dry run: index %s would be force merged to %d segments after a successful load", options.Index, *forcemerge)
+		}
+		if *alias != "" {
+			log.Printf("dry run: alias %s would be added after a successful load", *alias)
+		}
+		stats, err := runFiles(context.Background(), options, filenames, *compression, *progressEvery, nil, nil)
 		if err != nil {
-			log.Fatal(err)
+			if serr := writeStats(stats, *statsJSON, *statsFile); serr != nil {
+				warnf("cannot write stats: %v", serr)
+			}
+			fatal(err)
 		}
-		if options.Verbose {
-			log.Printf("index flushed: %s\n", resp.Status)
+		log.Printf("dry run: %d docs, %d bulk requests, %d bytes, %d docs skipped",
+			stats.Docs, stats.Batches, stats.Bytes, stats.Failed)
+		if err := writeStats(stats, *statsJSON, *statsFile); err != nil {
+			fatal(err)
+		}
+		if stats.Failed > 0 {
+			os.Exit(exitPartial)
 		}
+		os.Exit(0)
+	}
+
+	// Stop reading on SIGINT or SIGTERM, but let the workers finish and
+	// restore the index settings. This is set up before the first request,
+	// that changes the cluster, so a signal during the setup lets it complete
+	// and skips the load, but still ends with the settings restored.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		// Restore default signal handling, so another signal will exit.
+		<-ctx.Done()
+		stop()
 	}()
 
-	// Realtime search.
-	resp, err = indexSettingsRequest(`{"index": {"refresh_interval": "-1"}}`, options)
-	if err != nil {
-		log.Fatal(err)
+	if *purge {
+		if err := esbulk.DeleteIndex(options); err != nil {
+			fatal(err)
+		}
+		time.Sleep(5 * time.Second)
 	}
-	if resp.StatusCode >= 400 {
-		log.Fatal(resp)
+
+	if *templateName != "" {
+		f, err := os.Open(*templateFile)
+		if err != nil {
+			fatal(err)
+		}
+		err = esbulk.PutIndexTemplate(options, *templateName, f)
+		f.Close()
+		if err != nil {
+			fatal(err)
+		}
 	}
-	if *zeroReplica {
-		// Reset number of replicas.
-		if _, err := indexSettingsRequest(`{"index": {"number_of_replicas": 0}}`, options); err != nil {
-			log.Fatal(err)
+
+	// The backing indices of a data stream are created by elasticsearch, from
+	// the index template, and rolled over, so their settings are not touched,
+	// same for the indices behind an alias with -rollover-max-docs.
+	// With -template-auto-create, a missing index is left to elasticsearch to
+	// create from the template with the first bulk request, so there are no
+	// index settings to adjust either.
+	manageIndex := true
+	if *rolloverMaxDocs > 0 && !*dataStream {
+		manageIndex = false
+		indices, err := esbulk.AliasIndices(options, options.Index)
+		if err != nil {
+			fatal(err)
+		}
+		if len(indices) == 0 {
+			fatalf("-rollover-max-docs requires -index to be an alias with a write index, like logs-000001, or a -data-stream, %s is neither", options.Index)
+		}
+	}
+	if *dataStream {
+		manageIndex = false
+		if *createDataStream {
+			if err := esbulk.CreateDataStream(options); err != nil {
+				fatal(err)
+			}
+		}
+	}
+	if *templateAutoCreate && manageIndex {
+		exists, err := esbulk.IndexExists(options)
+		if err != nil {
+			fatal(err)
+		}
+		if !exists {
+			manageIndex = false
+			if *zeroReplica || *replicasAfter >= 0 {
+				warnf("index %s does not exist yet, ignoring -0 and -replicas-after", options.Index)
+			}
+			if *verbose {
+				log.Printf("index %s will be created from template %s", options.Index, *templateName)
+			}
 		}
 	}
 
-	reader := bufio.NewReader(file)
-	if *gzipped {
-		zreader, err := gzip.NewReader(file)
+	// A mapping given as create index body, with mappings and settings, and
+	// the -settings-file are applied when the index is created, so settings,
+	// like analyzers, are in place for the mappings. For an existing index,
+	// dynamic settings are updated and the mappings are put.
+	mappingBody, err := readMapping(*mapping, *mappingsFile)
+	if err != nil {
+		fatal(err)
+	}
+	var create esbulk.Mapping
+	if mappingBody != nil {
+		if create, err = esbulk.ParseMapping(mappingBody); err != nil {
+			fatal(err)
+		}
+	}
+	settings := flattenSettings(create.Settings)
+	if *settingsFile != "" {
+		fileSettings, err := readSettings(*settingsFile)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
+		}
+		if err := mergeSettings(settings, fileSettings, "-settings-file", "-mapping"); err != nil {
+			fatal(err)
+		}
+	}
+	if manageIndex && (create.Create || len(settings) > 0) {
+		exists, err := esbulk.IndexExists(options)
+		if err != nil {
+			fatal(err)
+		}
+		switch {
+		case !exists:
+			if create.Create {
+				options.IndexMappings = create.Mappings
+				mappingBody = nil
+			}
+			for k, v := range settings {
+				if options.IndexSettings == nil {
+					options.IndexSettings = make(map[string]interface{})
+				}
+				// Flags, like -shards, take precedence.
+				if _, ok := options.IndexSettings[k]; !ok {
+					options.IndexSettings[k] = v
+				}
+			}
+		case len(settings) > 0:
+			dynamic, static := dynamicSettings(settings)
+			if len(static) > 0 {
+				warnf("index %s exists, ignoring settings, that can only be set on creation: %s",
+					options.Index, strings.Join(static, ", "))
+			}
+			if len(dynamic) > 0 {
+				b, err := json.Marshal(map[string]interface{}{"index": dynamic})
+				if err != nil {
+					fatal(err)
+				}
+				if err := indexSettingsRequest(string(b), options); err != nil {
+					fatal(err)
+				}
+			}
+		}
+	}
+
+	// create index if not exists
+	if manageIndex {
+		if err := esbulk.CreateIndex(options); err != nil {
+			fatal(err)
+		}
+	}
+
+	if mappingBody != nil {
+		m := bytes.NewReader(mappingBody)
+		if create.Create {
+			// The settings are applied above.
+			m = bytes.NewReader(create.Mappings)
+		}
+		if err := esbulk.PutMapping(options, m); err != nil {
+			fatal(err)
 		}
-		reader = bufio.NewReader(zreader)
 	}
 
-	counter := 0
-	start := time.Now()
+	var m *metrics
+	var metricsServer *http.Server
+	if *metricsAddr != "" {
+		m = newMetrics(prometheus.DefaultRegisterer)
+		if metricsServer, err = serveMetrics(*metricsAddr); err != nil {
+			fatal(err)
+		}
+	}
 
-	for {
-		line, err := reader.ReadString('\n')
-		if err == io.EOF {
-			break
+	// With -no-settings-tweak, the index settings are not read or changed and
+	// the index is not flushed.
+	shutdown := func() {}
+	if manageIndex && !*noSettingsTweak {
+		// Store number_of_replicas and refresh_interval settings for
+		// restoration later.
+		req, err := options.NewRequest("GET", esbulk.Path(options.Index, "_settings"), nil)
+		if err != nil {
+			fatal(err)
 		}
+		resp, err := options.Do(req)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
-		line = strings.TrimSpace(line)
-		if len(line) == 0 {
-			continue
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			fatalf("could not get settings: %s", req.URL)
+		}
+
+		var doc map[string]struct {
+			Settings struct {
+				Index map[string]interface{} `json:"index"`
+			} `json:"settings"`
+		}
+		dec := json.NewDecoder(resp.Body)
+		if err := dec.Decode(&doc); err != nil {
+			fatal(err)
+		}
+		// Example response.
+		// {
+		// 	"ai": {
+		// 	  "settings": {
+		// 		"index": {
+		// 		  "refresh_interval": "1s",
+		// 		  "number_of_shards": "5",
+		// 		  "provided_name": "ai",
+		// 		  "creation_date": "1523372145102",
+		// 		  "number_of_replicas": "1",
+		// 		  "uuid": "5k-id0OZTKKU4A7DeeUNdQ",
+		// 		  "version": {
+		// 			"created": "6020399"
+		// 		  }
+		// 		}
+		// 	  }
+		// 	}
+		// }
+
+		// The response is keyed by the concrete index, which differs from
+		// the requested name for date math names, like <logs-{now/d}>.
+		entry, ok := doc[options.Index]
+		if !ok && len(doc) == 1 {
+			for _, v := range doc {
+				entry, ok = v, true
+			}
+		}
+		if !ok || entry.Settings.Index == nil {
+			fatalf("could not get settings of %s: %s", options.Index, req.URL)
 		}
-		queue <- line
-		counter++
+		indexSettings := entry.Settings.Index
+		numberOfReplicas := indexSettings["number_of_replicas"]
+		if *replicasAfter >= 0 {
+			numberOfReplicas = strconv.Itoa(*replicasAfter)
+		}
+		if *verbose {
+			log.Printf("on shutdown, number_of_replicas will be set back to %s", numberOfReplicas)
+		}
+		// Without an explicit value, the index uses the cluster default,
+		// which is restored with null.
+		var refreshInterval interface{} = indexSettings["refresh_interval"]
+		if *refreshAfter != "" {
+			refreshInterval = *refreshAfter
+		} else if refreshInterval == "-1" {
+			warnf("refresh_interval of %s is already -1, maybe from an interrupted load, use -refresh-interval to set it afterwards", options.Index)
+		}
+		restoreRefresh, err := json.Marshal(refreshInterval)
+		if err != nil {
+			fatal(err)
+		}
+		if *verbose {
+			log.Printf("on shutdown, refresh_interval will be set back to %s", restoreRefresh)
+		}
+
+		// Shutdown procedure, run after all workers are done, even if indexing
+		// was interrupted by a signal.
+		shutdown = func() {
+			// Try to restore both settings, even if one fails.
+			var restoreErr error
+			// Realtime search.
+			if err := indexSettingsRequest(fmt.Sprintf(`{"index": {"refresh_interval": %s}}`, restoreRefresh), options); err != nil {
+				restoreErr = err
+			}
+			// Reset number of replicas.
+			if err := indexSettingsRequest(fmt.Sprintf(`{"index": {"number_of_replicas": %q}}`, numberOfReplicas), options); err != nil && restoreErr == nil {
+				restoreErr = err
+			}
+			if restoreErr != nil {
+				fatalf("cannot restore settings of %s: %v", options.Index, restoreErr)
+			}
+
+			// Persist documents.
+			req, err := options.NewRequest("POST", esbulk.Path(options.Index, "_flush"), nil)
+			if err != nil {
+				fatal(err)
+			}
+			resp, err := options.Do(req)
+			if err != nil {
+				fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 400 {
+				warnf("flush failed: %s", resp.Status)
+			} else if options.Verbose {
+				log.Printf("index flushed: %s\n", resp.Status)
+			}
+		}
+
+		// Realtime search. Bulk requests with refresh need the periodic
+		// refresh, wait_for would otherwise block until the load is done.
+		if *bulkRefresh == "false" {
+			if err := indexSettingsRequest(`{"index": {"refresh_interval": "-1"}}`, options); err != nil {
+				fatal(err)
+			}
+		}
+		if *zeroReplica {
+			// Reset number of replicas, restoring refresh on failure.
+			if err := indexSettingsRequest(`{"index": {"number_of_replicas": 0}}`, options); err != nil {
+				shutdown()
+				fatal(err)
+			}
+		}
+	}
+
+	// Check the rollover condition periodically, while the workers index
+	// into the alias, and once more at the end.
+	stopRollover := func() {}
+	if *rolloverMaxDocs > 0 {
+		rollover := func() {
+			index, err := esbulk.Rollover(options, *rolloverMaxDocs)
+			switch {
+			case err != nil:
+				warnf("%v", err)
+			case index != "" && *verbose:
+				log.Printf("rolled %s over to %s", options.Index, index)
+			}
+		}
+		rolloverCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		stopRollover = func() {
+			cancel()
+			<-done
+		}
+		go func() {
+			defer close(done)
+			ticker := time.NewTicker(*rolloverEvery)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					rollover()
+				case <-rolloverCtx.Done():
+					if ctx.Err() == nil {
+						rollover()
+					}
+					return
+				}
+			}
+		}()
 	}
 
-	close(queue)
-	wg.Wait()
-	elapsed := time.Since(start)
+	stats, err := runFiles(ctx, options, filenames, *compression, *progressEvery, m, cp)
+	stopRollover()
+	if err == context.Canceled {
+		log.Printf("interrupted, stopping after %d docs", stats.Docs)
+	}
+	if cp != nil {
+		if err := cp.save(); err != nil {
+			warnf("cannot save checkpoint: %v", err)
+		}
+	}
+	shutdown()
+	// Make documents searchable right away, without waiting for the next
+	// refresh, whether the settings were changed or not, so also for data
+	// streams and rollover aliases, where the refresh covers all indices.
+	if *refresh {
+		if rerr := refreshIndex(options); rerr != nil {
+			warnf("%v", rerr)
+		}
+	}
+	if err != nil && err != context.Canceled {
+		var berr *esbulk.BatchError
+		if errors.As(err, &berr) && *verbose {
+			log.Printf("first document of failed batch: %s", berr.Payload)
+		}
+		// Report how far the load got, before giving up.
+		if serr := writeStats(stats, *statsJSON, *statsFile); serr != nil {
+			warnf("cannot write stats: %v", serr)
+		}
+		fatal(err)
+	}
 
 	if *memprofile != "" {
 		f, err := os.Create(*memprofile)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 		pprof.WriteHeapProfile(f)
 		f.Close()
 	}
 
+	if *verbose && *sample > 0 {
+		log.Printf("sampled %d of %d docs", stats.Docs, stats.Docs+stats.Unsampled)
+	}
 	if *verbose {
-		rate := float64(counter) / elapsed.Seconds()
-		log.Printf("%d docs in %s at %0.3f docs/s with %d workers\n", counter, elapsed, rate, *numWorkers)
+		rate := float64(stats.Docs) / stats.Elapsed.Seconds()
+		log.Printf("%d docs in %s at %0.3f docs/s with %d workers, %d bulk requests, %d bytes sent\n",
+			stats.Docs, stats.Elapsed, rate, *numWorkers, stats.Batches, stats.Bytes)
+		if *maxRate > 0 {
+			log.Printf("rate limited to %0.3f docs/s", *maxRate)
+		}
+		if maxBytesPerSec > 0 {
+			log.Printf("rate limited to %d bytes/s, sent %0.3f bytes/s",
+				maxBytesPerSec, float64(stats.Bytes)/stats.Elapsed.Seconds())
+		}
+	}
+	if stats.Failed > 0 {
+		log.Printf("%d of %d docs failed to index", stats.Failed, stats.Docs)
+	}
+	if err := writeStats(stats, *statsJSON, *statsFile); err != nil {
+		fatal(err)
+	}
+	shutdownMetrics(metricsServer)
+	// Merging is only worth it for a complete and read only index.
+	if *forcemerge > 0 {
+		if err != nil || stats.Failed > 0 {
+			warnf("load incomplete, not force merging %s", options.Index)
+		} else if err := esbulk.ForceMerge(options, *forcemerge, *forcemergeTimeout); err != nil {
+			fatal(err)
+		}
+	}
+	// Only point the alias to a complete index.
+	if *alias != "" {
+		if err != nil || stats.Failed > 0 {
+			warnf("load incomplete, not updating alias %s", *alias)
+		} else if err := esbulk.UpdateAlias(options, *alias, *aliasSwap); err != nil {
+			fatal(err)
+		}
+	}
+	if err == context.Canceled {
+		os.Exit(exitError)
+	}
+	if stats.Failed > 0 {
+		os.Exit(exitPartial)
 	}
 }
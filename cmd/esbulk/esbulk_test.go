@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestParseUser(t *testing.T) {
+	var cases = []struct {
+		user         string
+		passwordFile bool
+		username     string
+		password     string
+		err          bool
+	}{
+		{user: "elastic:changeme", username: "elastic", password: "changeme"},
+		{user: "elastic:p:a:ss", username: "elastic", password: "p:a:ss"},
+		{user: "elastic:", username: "elastic", password: ""},
+		{user: "elastic:-", username: "elastic", password: "-"},
+		{user: "elastic", passwordFile: true, username: "elastic"},
+		{user: "elastic", err: true},
+	}
+	for _, c := range cases {
+		username, password, err := parseUser(c.user, c.passwordFile)
+		if (err != nil) != c.err {
+			t.Errorf("%s: got %v, want error %v", c.user, err, c.err)
+			continue
+		}
+		if username != c.username || password != c.password {
+			t.Errorf("%s: got %q %q, want %q %q", c.user, username, password, c.username, c.password)
+		}
+	}
+}
+
+func TestEnvCredentials(t *testing.T) {
+	var cases = []struct {
+		about                      string
+		env                        map[string]string
+		apiKey, username, password string
+	}{
+		{about: "no environment, flags are kept", apiKey: "flagkey"},
+		{about: "api key overrides flags", env: map[string]string{"ES_API_KEY": "envkey"}, apiKey: "envkey"},
+		{about: "username overrides flags", env: map[string]string{"ES_USERNAME": "elastic", "ES_PASSWORD": "changeme"}, username: "elastic", password: "changeme"},
+		{about: "api key wins over username", env: map[string]string{"ES_API_KEY": "envkey", "ES_USERNAME": "elastic"}, apiKey: "envkey"},
+	}
+	for _, c := range cases {
+		t.Run(c.about, func(t *testing.T) {
+			for _, k := range []string{"ES_API_KEY", "ES_USERNAME", "ES_PASSWORD"} {
+				t.Setenv(k, c.env[k])
+			}
+			apiKey, username, password := envCredentials("flagkey", "", "")
+			if apiKey != c.apiKey || username != c.username || password != c.password {
+				t.Errorf("got %q %q %q, want %q %q %q", apiKey, username, password, c.apiKey, c.username, c.password)
+			}
+		})
+	}
+}
+
+func TestEnvServers(t *testing.T) {
+	t.Setenv("ES_SERVER", "")
+	if got := envServers([]string{"http://flag:9200"}); len(got) != 1 || got[0] != "http://flag:9200" {
+		t.Errorf("got %v, want the server from the flag", got)
+	}
+	t.Setenv("ES_SERVER", "http://env:9200")
+	if got := envServers([]string{"http://flag:9200"}); len(got) != 1 || got[0] != "http://env:9200" {
+		t.Errorf("got %v, want the server from the environment", got)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/miku/esbulk"
+)
+
+// structured is set, if logs are written with a slog handler, instead of the
+// plain log package format.
+var structured bool
+
+// setupLogging configures the log format, text or json, and the minimum
+// level, debug, info, warn or error. With the default text format and info
+// level, the log package output is kept as is. Otherwise, all log output,
+// including that of the esbulk package, goes through slog at info level.
+func setupLogging(format, level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unknown log level: %s", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	var h slog.Handler
+	switch format {
+	case "text":
+		if lvl == slog.LevelInfo {
+			return nil
+		}
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+	slog.SetDefault(slog.New(h))
+	structured = true
+	return nil
+}
+
+// warnf logs a warning.
+func warnf(format string, v ...interface{}) {
+	if !structured {
+		log.Printf("warning: "+format, v...)
+		return
+	}
+	slog.Warn(fmt.Sprintf(format, v...))
+}
+
+// fatal logs an error and exits. For a failed batch, the worker, batch and
+// status are logged as separate fields.
+func fatal(v ...interface{}) {
+	if !structured {
+		log.Fatal(v...)
+	}
+	var attrs []interface{}
+	if len(v) == 1 {
+		if err, ok := v[0].(error); ok {
+			var berr *esbulk.BatchError
+			if errors.As(err, &berr) {
+				attrs = append(attrs, "worker", berr.Worker, "batch", berr.Batch, "docs", berr.Docs)
+				if berr.StatusCode > 0 {
+					attrs = append(attrs, "status", berr.StatusCode)
+				}
+			}
+		}
+	}
+	slog.Error(strings.TrimSuffix(fmt.Sprint(v...), "\n"), attrs...)
+	os.Exit(exitError)
+}
+
+// fatalf logs a formatted error and exits.
+func fatalf(format string, v ...interface{}) {
+	if !structured {
+		log.Fatalf(format, v...)
+	}
+	slog.Error(fmt.Sprintf(format, v...))
+	os.Exit(exitError)
+}
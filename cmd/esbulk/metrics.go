@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/miku/esbulk"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics collects counters and a latency histogram in a prometheus
+// registry.
+type metrics struct {
+	mu       sync.Mutex
+	stats    esbulk.Stats
+	retries  prometheus.Counter
+	errors   prometheus.Counter // Bulk requests, that failed with an error.
+	duration prometheus.Histogram
+}
+
+// newMetrics registers the metrics with reg.
+func newMetrics(reg prometheus.Registerer) *metrics {
+	m := &metrics{
+		retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "esbulk_bulk_retries_total",
+			Help: "Bulk requests, that were retried.",
+		}),
+		errors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "esbulk_bulk_errors_total",
+			Help: "Bulk requests, that failed with a connection or HTTP error.",
+		}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "esbulk_bulk_request_duration_seconds",
+			Help:    "Latency of bulk requests.",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+	// The stats are totals, kept up to date by update, so they are read on
+	// scrape.
+	counter := func(name, help string, value func(s esbulk.Stats) int64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{Name: name, Help: help}, func() float64 {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			return float64(value(m.stats))
+		})
+	}
+	reg.MustRegister(
+		counter("esbulk_docs_read_total", "Documents read from the input.",
+			func(s esbulk.Stats) int64 { return s.Docs }),
+		counter("esbulk_docs_indexed_total", "Documents accepted by elasticsearch.",
+			func(s esbulk.Stats) int64 { return s.Indexed }),
+		counter("esbulk_docs_failed_total", "Documents rejected by elasticsearch or skipped.",
+			func(s esbulk.Stats) int64 { return s.Failed }),
+		counter("esbulk_bytes_sent_total", "Bytes sent in successful bulk requests.",
+			func(s esbulk.Stats) int64 { return s.Bytes }),
+		m.retries,
+		m.errors,
+		m.duration,
+	)
+	return m
+}
+
+// update sets the current stats.
+func (m *metrics) update(s esbulk.Stats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats = s
+}
+
+// observe records a bulk request, it is used as esbulk.Options.OnBulk.
+func (m *metrics) observe(attempt int, took time.Duration, err error) {
+	if attempt > 0 {
+		m.retries.Inc()
+	}
+	var ierr *esbulk.ItemsError
+	if err != nil && !errors.As(err, &ierr) {
+		m.errors.Inc()
+	}
+	m.duration.Observe(took.Seconds())
+}
+
+// serveMetrics starts serving the metrics of the default prometheus registry
+// at addr under /metrics. The listener is opened before returning, so an
+// address in use is reported right away.
+func serveMetrics(addr string) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("metrics: %v", err)
+		}
+	}()
+	return srv, nil
+}
+
+// shutdownMetrics stops the metrics server, waiting a few seconds for
+// running scrapes.
+func shutdownMetrics(srv *http.Server) {
+	if srv == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("metrics: %v", err)
+	}
+}
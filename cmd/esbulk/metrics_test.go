@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miku/esbulk"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// scrape returns the metrics after a few observed bulk requests.
+func scrape(t *testing.T) string {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	m := newMetrics(reg)
+	m.update(esbulk.Stats{Docs: 5, Indexed: 4, Failed: 1, Bytes: 100})
+	m.observe(0, 20*time.Millisecond, nil)
+	m.observe(1, 2*time.Second, &esbulk.StatusError{StatusCode: 429})
+	m.observe(0, 30*time.Millisecond, &esbulk.ItemsError{Failed: 1, Total: 2})
+	w := httptest.NewRecorder()
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("got content type %s, want text/plain; version=0.0.4", ct)
+	}
+	return w.Body.String()
+}
+
+func TestMetrics(t *testing.T) {
+	body := scrape(t)
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(body, "\n") {
+		lines[line] = true
+	}
+	var want = []string{
+		"# TYPE esbulk_docs_read_total counter",
+		"esbulk_docs_read_total 5",
+		"esbulk_docs_indexed_total 4",
+		"esbulk_docs_failed_total 1",
+		"esbulk_bytes_sent_total 100",
+		"esbulk_bulk_retries_total 1",
+		"esbulk_bulk_errors_total 1",
+		"# TYPE esbulk_bulk_request_duration_seconds histogram",
+		`esbulk_bulk_request_duration_seconds_bucket{le="0.01"} 0`,
+		`esbulk_bulk_request_duration_seconds_bucket{le="0.025"} 1`,
+		`esbulk_bulk_request_duration_seconds_bucket{le="0.05"} 2`,
+		`esbulk_bulk_request_duration_seconds_bucket{le="1"} 2`,
+		`esbulk_bulk_request_duration_seconds_bucket{le="2.5"} 3`,
+		`esbulk_bulk_request_duration_seconds_bucket{le="+Inf"} 3`,
+		"esbulk_bulk_request_duration_seconds_sum 2.05",
+		"esbulk_bulk_request_duration_seconds_count 3",
+	}
+	for _, line := range want {
+		if !lines[line] {
+			t.Errorf("missing line %q in:\n%s", line, body)
+		}
+	}
+	if !strings.HasSuffix(body, "\n") {
+		t.Errorf("want a final newline")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/miku/esbulk"
+)
+
+// countingReader counts the bytes read.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+// inputSize returns the total size of all files, or zero, if it is unknown,
+// e.g. when reading from stdin.
+func inputSize(filenames []string) int64 {
+	var size int64
+	for _, filename := range filenames {
+		if filename == "-" {
+			return 0
+		}
+		fi, err := os.Stat(filename)
+		if err != nil || !fi.Mode().IsRegular() {
+			return 0
+		}
+		size += fi.Size()
+	}
+	return size
+}
+
+// progress logs the number of documents and the current rate. If the input
+// size is known, the remaining time is estimated from the bytes read so far.
+type progress struct {
+	start    time.Time
+	last     time.Time
+	lastDocs int64
+	every    time.Duration
+	size     int64  // Total input size, zero if unknown.
+	read     *int64 // Input bytes read.
+}
+
+func newProgress(size int64, read *int64, every time.Duration) *progress {
+	now := time.Now()
+	return &progress{start: now, last: now, every: every, size: size, read: read}
+}
+
+// due returns true, if the next progress should be logged, given that it is
+// checked at the interval.
+func (p *progress) due(interval time.Duration) bool {
+	return time.Since(p.last) >= p.every-interval/2
+}
+
+func (p *progress) log(s esbulk.Stats) {
+	now := time.Now()
+	rate := float64(s.Docs-p.lastDocs) / now.Sub(p.last).Seconds()
+	p.last, p.lastDocs = now, s.Docs
+	msg := fmt.Sprintf("%d docs read, %d indexed, %d failed, %0.1f docs/s",
+		s.Docs, s.Indexed, s.Failed, rate)
+	if p.size > 0 {
+		if f := float64(atomic.LoadInt64(p.read)) / float64(p.size); f > 0 {
+			eta := time.Duration(float64(now.Sub(p.start)) * (1 - f) / f)
+			msg += fmt.Sprintf(", %0.1f%% read, eta %s", 100*f, eta.Round(time.Second))
+		}
+	}
+	log.Println(msg)
+}
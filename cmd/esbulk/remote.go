@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// isURL returns true, if an input argument is an http or https URL.
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// inputName returns a name for an input argument to use in messages, without
+// the query of a URL, which may contain a signature.
+func inputName(s string) string {
+	if !isURL(s) {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "..."
+	}
+	return u.Redacted()
+}
+
+// openURL streams a remote file. It returns the body and the compression to
+// use, which is guessed from the content type or the path for "auto" and
+// "none", as there is no use for compressed documents otherwise. The
+// request is sent with the default client, never with the credentials used
+// for elasticsearch.
+func openURL(ctx context.Context, rawurl, compression string) (io.ReadCloser, string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, "", err
+	}
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if uerr, ok := err.(*url.Error); ok {
+		// Do not repeat the URL, with a possible signature.
+		return nil, "", uerr.Err
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, "", fmt.Errorf("cannot download: %s", resp.Status)
+	}
+	switch {
+	case resp.Uncompressed:
+		// Already decoded from Content-Encoding gzip by the transport.
+		compression = "none"
+	case compression == "auto" || compression == "none":
+		switch resp.Header.Get("Content-Type") {
+		case "application/gzip", "application/x-gzip":
+			compression = "gzip"
+		case "application/x-bzip2":
+			compression = "bzip2"
+		case "application/zstd":
+			compression = "zstd"
+		default:
+			// Ignore the query, e.g. of presigned URLs.
+			compression = compressionFromExtension(u.Path)
+		}
+	}
+	return resp.Body, compression, nil
+}
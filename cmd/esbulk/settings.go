@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// staticSettings can only be set when an index is created, or on a closed
+// index, prefixes end with a dot.
+var staticSettings = []string{
+	"analysis.",
+	"codec",
+	"load_fixed_bitset_filters_eagerly",
+	"number_of_routing_shards",
+	"number_of_shards",
+	"routing_partition_size",
+	"shard.check_on_startup",
+	"similarity.",
+	"soft_deletes.enabled",
+	"sort.",
+}
+
+// readMapping returns the mapping from a file or, if there is no file with
+// that name, the -mapping string itself, or nil, if neither is given.
+func readMapping(mapping, mappingsFile string) ([]byte, error) {
+	switch {
+	case mappingsFile != "":
+		return os.ReadFile(mappingsFile)
+	case mapping == "":
+		return nil, nil
+	}
+	if _, err := os.Stat(mapping); os.IsNotExist(err) {
+		return []byte(mapping), nil
+	}
+	return os.ReadFile(mapping)
+}
+
+// readSettings reads index settings from a file, either just the settings or
+// wrapped in {"settings": ...}, as in a create index body. The settings are
+// flattened, see flattenSettings.
+func readSettings(filename string) (map[string]interface{}, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var settings map[string]interface{}
+	if err := json.Unmarshal(b, &settings); err != nil {
+		return nil, fmt.Errorf("invalid settings %s: %v", filename, err)
+	}
+	if inner, ok := settings["settings"].(map[string]interface{}); ok && len(settings) == 1 {
+		settings = inner
+	}
+	return flattenSettings(settings), nil
+}
+
+// flattenSettings returns settings with nested keys joined by dots and
+// without the index prefix, so {"index": {"analysis": {"analyzer": ...}}} and
+// {"index.analysis.analyzer": ...} both become analysis.analyzer, which
+// elasticsearch accepts as well.
+func flattenSettings(settings map[string]interface{}) map[string]interface{} {
+	flat := make(map[string]interface{})
+	var walk func(prefix string, m map[string]interface{})
+	walk = func(prefix string, m map[string]interface{}) {
+		for k, v := range m {
+			key := prefix + k
+			if inner, ok := v.(map[string]interface{}); ok && len(inner) > 0 {
+				walk(key+".", inner)
+				continue
+			}
+			flat[strings.TrimPrefix(key, "index.")] = v
+		}
+	}
+	walk("", settings)
+	return flat
+}
+
+// mergeSettings adds the settings from src to dst, where they must not be set
+// already.
+func mergeSettings(dst, src map[string]interface{}, srcName, dstName string) error {
+	var overlap []string
+	for k := range src {
+		if _, ok := dst[k]; ok {
+			overlap = append(overlap, k)
+		}
+	}
+	if len(overlap) > 0 {
+		sort.Strings(overlap)
+		return fmt.Errorf("%s and %s both set %s", srcName, dstName, strings.Join(overlap, ", "))
+	}
+	for k, v := range src {
+		dst[k] = v
+	}
+	return nil
+}
+
+// dynamicSettings splits flat settings into those, which can be updated on an
+// open index, and the names of the others.
+func dynamicSettings(settings map[string]interface{}) (dynamic map[string]interface{}, static []string) {
+	dynamic = make(map[string]interface{})
+	for k, v := range settings {
+		if isStaticSetting(k) {
+			static = append(static, k)
+			continue
+		}
+		dynamic[k] = v
+	}
+	sort.Strings(static)
+	return dynamic, static
+}
+
+func isStaticSetting(key string) bool {
+	for _, s := range staticSettings {
+		if key == s || (strings.HasSuffix(s, ".") && strings.HasPrefix(key, s)) {
+			return true
+		}
+	}
+	return false
+}
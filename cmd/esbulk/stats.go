@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/miku/esbulk"
+)
+
+// statsReport is the machine readable summary of a run.
+type statsReport struct {
+	Docs           int64         `json:"docs"`
+	Indexed        int64         `json:"indexed"`
+	Failed         int64         `json:"failed"`
+	Bytes          int64         `json:"bytes"`
+	Batches        int64         `json:"batches"`
+	ElapsedSeconds float64       `json:"elapsed_seconds"`
+	DocsPerSecond  float64       `json:"docs_per_second"`
+	Workers        []workerStats `json:"workers"`
+}
+
+type workerStats struct {
+	Worker  string `json:"worker"`
+	Indexed int64  `json:"indexed"`
+	Failed  int64  `json:"failed"`
+	Bytes   int64  `json:"bytes"`
+	Batches int64  `json:"batches"`
+}
+
+// writeStats writes the stats as JSON to a file, which is truncated, if
+// filename is not empty, and to stdout, if toStdout is set.
+func writeStats(s esbulk.Stats, toStdout bool, filename string) error {
+	if !toStdout && filename == "" {
+		return nil
+	}
+	report := statsReport{
+		Docs:           s.Docs,
+		Indexed:        s.Indexed,
+		Failed:         s.Failed,
+		Bytes:          s.Bytes,
+		Batches:        s.Batches,
+		ElapsedSeconds: s.Elapsed.Seconds(),
+		Workers:        []workerStats{},
+	}
+	if s.Elapsed > 0 {
+		report.DocsPerSecond = float64(s.Docs) / s.Elapsed.Seconds()
+	}
+	for _, w := range s.Workers {
+		report.Workers = append(report.Workers, workerStats(w))
+	}
+	if toStdout {
+		if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+			return err
+		}
+	}
+	if filename == "" {
+		return nil
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(report); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miku/esbulk"
+)
+
+func TestWriteStatsBoth(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "stats.json")
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	err = writeStats(esbulk.Stats{Docs: 4, Indexed: 3, Failed: 1, Elapsed: 2 * time.Second}, true, filename)
+	os.Stdout = stdout
+	w.Close()
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	printed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range [][]byte{printed, written} {
+		var report statsReport
+		if err := json.Unmarshal(b, &report); err != nil {
+			t.Fatalf("got %v, want nil for %q", err, b)
+		}
+		if report.Docs != 4 || report.Failed != 1 || report.DocsPerSecond != 2 {
+			t.Errorf("got %+v, want 4 docs, 1 failed, 2 docs/s", report)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// newTransport returns a transport, that keeps idlePerHost connections per
+// server open for reuse, so many workers do not need to reconnect for each
+// request. Connections use TCP keep-alive and idle connections are closed
+// after 90 seconds, as with the default transport. If maxPerHost is positive,
+// it limits the number of connections per server. Requests go through the
+// proxy, if given, otherwise through the proxy from HTTP_PROXY, HTTPS_PROXY
+// and NO_PROXY, as set when the transport is created. Unlike with
+// http.ProxyFromEnvironment, the environment is not cached for the process.
+func newTransport(tc *tls.Config, proxy *url.URL, idlePerHost, maxPerHost, servers int) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tc
+	envProxy := httpproxy.FromEnvironment().ProxyFunc()
+	t.Proxy = func(req *http.Request) (*url.URL, error) {
+		return envProxy(req.URL)
+	}
+	if proxy != nil {
+		t.Proxy = http.ProxyURL(proxy)
+	}
+	t.MaxIdleConnsPerHost = idlePerHost
+	if n := idlePerHost * servers; n > t.MaxIdleConns {
+		t.MaxIdleConns = n
+	}
+	t.MaxConnsPerHost = maxPerHost
+	t.IdleConnTimeout = 90 * time.Second
+	return t
+}
+
+// tlsConfig builds a TLS configuration from an optional CA certificate file
+// and an optional client certificate and key for mutual TLS. If no CA file is
+// given, SSL_CERT_FILE is used, if set. With insecure, server certificates are
+// not verified at all.
+func tlsConfig(caFile, certFile, keyFile string, insecure bool) (*tls.Config, error) {
+	if caFile == "" {
+		caFile = os.Getenv("SSL_CERT_FILE")
+	}
+	if caFile == "" && certFile == "" && keyFile == "" && !insecure {
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		b, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no PEM encoded certificates found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("client certificate requires both -cert and -key")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
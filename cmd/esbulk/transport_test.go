@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTransportProxy(t *testing.T) {
+	// Requests to loopback addresses are never proxied, so the servers are
+	// given names, that the dialer resolves to the direct server.
+	direct := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "direct")
+	}))
+	defer direct.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "proxy "+r.URL.Host)
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The environment is read, when the transport is created.
+	t.Setenv("HTTP_PROXY", proxy.URL)
+	t.Setenv("NO_PROXY", "es.internal")
+
+	var cases = []struct {
+		about string
+		proxy *url.URL
+		url   string
+		want  string
+	}{
+		{"proxy from environment", nil, "http://es.example/", "proxy es.example"},
+		{"no proxy for host", nil, "http://es.internal/", "direct"},
+		{"explicit proxy", proxyURL, "http://es.internal/", "proxy es.internal"},
+	}
+	for _, c := range cases {
+		transport := newTransport(nil, c.proxy, 1, 0, 1)
+		dialer := &net.Dialer{}
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr == "es.example:80" || addr == "es.internal:80" {
+				addr = direct.Listener.Addr().String()
+			}
+			return dialer.DialContext(ctx, network, addr)
+		}
+		client := &http.Client{Transport: transport}
+		resp, err := client.Get(c.url)
+		if err != nil {
+			t.Errorf("%s: got %v, want nil", c.about, err)
+			continue
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != c.want {
+			t.Errorf("%s: got %q, want %q", c.about, b, c.want)
+		}
+		transport.CloseIdleConnections()
+	}
+}
+
+// BenchmarkTransportWorkers sends a request from each of 32 workers at once,
+// with the default transport, which keeps two idle connections per host, and
+// with one sized to the workers. New connections show the churn.
+func BenchmarkTransportWorkers(b *testing.B) {
+	const workers = 32
+	var conns int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, `{"took":1,"errors":false,"items":[]}`)
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+	body := strings.Repeat(`{"index":{}}`+"\n"+`{"a": 1}`+"\n", 100)
+	var cases = []struct {
+		name      string
+		transport *http.Transport
+	}{
+		{"default", http.DefaultTransport.(*http.Transport).Clone()},
+		{"pooled", newTransport(nil, nil, workers, 0, 1)},
+	}
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			client := &http.Client{Transport: c.transport}
+			defer c.transport.CloseIdleConnections()
+			atomic.StoreInt64(&conns, 0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var wg sync.WaitGroup
+				for j := 0; j < workers; j++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						resp, err := client.Post(srv.URL+"/_bulk", "application/x-ndjson", strings.NewReader(body))
+						if err != nil {
+							b.Error(err)
+							return
+						}
+						io.Copy(io.Discard, resp.Body)
+						resp.Body.Close()
+					}()
+				}
+				wg.Wait()
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(&conns))/float64(b.N), "conns/op")
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package esbulk
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// renameFields renames the fields of a document and its nested objects, up
+// to FieldDepth levels, or all, if zero. A field in RenameFields gets the
+// new name, any other field is converted to FieldCase, if set. Returns true,
+// if the document was changed, and an error, if two fields of an object end
+// up with the same name.
+func renameFields(docmap map[string]interface{}, options Options) (bool, error) {
+	return renameObject(docmap, options, 1)
+}
+
+func renameObject(m map[string]interface{}, options Options, depth int) (bool, error) {
+	var modified bool
+	// Sort the keys, so that a collision is reported the same way each time.
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	renamed := make(map[string]string, len(keys)) // New name to old name.
+	values := make(map[string]interface{}, len(keys))
+	for _, k := range keys {
+		name := fieldName(k, options)
+		if old, ok := renamed[name]; ok {
+			return false, fmt.Errorf("fields %s and %s are both renamed to %s", old, k, name)
+		}
+		renamed[name] = k
+		v := m[k]
+		if options.FieldDepth == 0 || depth < options.FieldDepth {
+			changed, err := renameValue(v, options, depth+1)
+			if err != nil {
+				return false, err
+			}
+			modified = modified || changed
+		}
+		values[name] = v
+		modified = modified || name != k
+	}
+	if !modified {
+		return false, nil
+	}
+	for k := range m {
+		delete(m, k)
+	}
+	for k, v := range values {
+		m[k] = v
+	}
+	return true, nil
+}
+
+// renameValue renames the fields of objects in a value, which may be an
+// object itself or an array of them.
+func renameValue(v interface{}, options Options, depth int) (bool, error) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return renameObject(t, options, depth)
+	case []interface{}:
+		var modified bool
+		for _, elem := range t {
+			changed, err := renameValue(elem, options, depth)
+			if err != nil {
+				return false, err
+			}
+			modified = modified || changed
+		}
+		return modified, nil
+	}
+	return false, nil
+}
+
+// fieldName returns the new name of a field.
+func fieldName(name string, options Options) string {
+	if s, ok := options.RenameFields[name]; ok {
+		return s
+	}
+	switch options.FieldCase {
+	case "lower":
+		return strings.ToLower(name)
+	case "snake":
+		return snakeCase(name)
+	}
+	return name
+}
+
+// snakeCase converts a name like FooBar, fooBar, HTTPServer or foo-bar to
+// foo_bar or http_server. Dots, which separate object fields, are kept.
+func snakeCase(s string) string {
+	runes := []rune(s)
+	var b strings.Builder
+	for i, r := range runes {
+		switch {
+		case r == '-' || unicode.IsSpace(r):
+			b.WriteRune('_')
+			continue
+		case unicode.IsUpper(r) && i > 0:
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteRune('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// pruneFields returns a document with only the KeepFields, along with added
+// fields, or without the DropFields. Fields are given as dotted paths, like
+// "a.b", fields, that a document does not have, are ignored. The document
+// itself is not changed, so that ids, versions and templates can still use
+// fields, that are not indexed.
+func pruneFields(docmap map[string]interface{}, options Options) map[string]interface{} {
+	if len(options.KeepFields) > 0 {
+		kept := make(map[string]interface{})
+		for _, name := range options.KeepFields {
+			keepField(kept, docmap, strings.Split(name, "."))
+		}
+		for k := range options.AddFields {
+			keepField(kept, docmap, []string{k})
+		}
+		if options.TimestampField != "" {
+			keepField(kept, docmap, []string{options.TimestampField})
+		}
+		return kept
+	}
+	for _, name := range options.DropFields {
+		docmap, _ = dropField(docmap, strings.Split(name, "."))
+	}
+	return docmap
+}
+
+// keepField copies the field at a path from src to dst, with the objects
+// along the path, and returns true, if the field was found. Objects along the
+// path of a missing field are not created.
+func keepField(dst, src map[string]interface{}, keys []string) bool {
+	v, ok := src[keys[0]]
+	if !ok {
+		return false
+	}
+	if len(keys) == 1 {
+		dst[keys[0]] = v
+		return true
+	}
+	inner, ok := v.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	if d, ok := dst[keys[0]].(map[string]interface{}); ok {
+		return keepField(d, inner, keys[1:])
+	}
+	d := make(map[string]interface{})
+	if !keepField(d, inner, keys[1:]) {
+		return false
+	}
+	dst[keys[0]] = d
+	return true
+}
+
+// dropField returns m without the field at a path, copying the objects along
+// the path instead of changing them, and true, if the field was found.
+func dropField(m map[string]interface{}, keys []string) (map[string]interface{}, bool) {
+	v, ok := m[keys[0]]
+	if !ok {
+		return m, false
+	}
+	if len(keys) > 1 {
+		inner, ok := v.(map[string]interface{})
+		if !ok {
+			return m, false
+		}
+		if v, ok = dropField(inner, keys[1:]); !ok {
+			return m, false
+		}
+	}
+	c := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	if len(keys) == 1 {
+		delete(c, keys[0])
+	} else {
+		c[keys[0]] = v
+	}
+	return c, true
+}
@@ -0,0 +1,40 @@
+package esbulk
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPruneFields(t *testing.T) {
+	doc := `{"a": 1, "b": {"c": 2, "d": {"e": 3, "f": 4}}, "g": [1, 2]}`
+	var cases = []struct {
+		about   string
+		options Options
+		want    string
+	}{
+		{"drop top level", Options{DropFields: []string{"a", "g"}}, `{"b":{"c":2,"d":{"e":3,"f":4}}}`},
+		{"drop nested", Options{DropFields: []string{"b.d.e"}}, `{"a":1,"b":{"c":2,"d":{"f":4}},"g":[1,2]}`},
+		{"drop object", Options{DropFields: []string{"b.d"}}, `{"a":1,"b":{"c":2},"g":[1,2]}`},
+		{"drop missing", Options{DropFields: []string{"x", "b.x", "a.x", "b.d.e.x"}}, `{"a":1,"b":{"c":2,"d":{"e":3,"f":4}},"g":[1,2]}`},
+		{"keep top level", Options{KeepFields: []string{"a"}}, `{"a":1}`},
+		{"keep nested", Options{KeepFields: []string{"b.d.f", "g"}}, `{"b":{"d":{"f":4}},"g":[1,2]}`},
+		{"keep missing", Options{KeepFields: []string{"x", "b.x", "a.x"}}, `{}`},
+		{"keep with added field", Options{KeepFields: []string{"a"}, AddFields: map[string]string{"s": "v"}}, `{"a":1,"s":"v"}`},
+	}
+	for _, c := range cases {
+		c.options.Index = "x"
+		_, body, _, err := BulkRequest([]string{doc}, c.options)
+		if err != nil {
+			t.Errorf("%s: got %v, want nil", c.about, err)
+			continue
+		}
+		lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+		if len(lines) != 2 {
+			t.Errorf("%s: got %q, want an action and a source line", c.about, body)
+			continue
+		}
+		if lines[1] != c.want {
+			t.Errorf("%s: got %s, want %s", c.about, lines[1], c.want)
+		}
+	}
+}
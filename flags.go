@@ -1,6 +1,10 @@
 package esbulk
 
-import "strings"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 // ArrayFlags allows to store lists of flag values.
 type ArrayFlags []string
@@ -14,3 +18,39 @@ func (f *ArrayFlags) Set(value string) error {
 	*f = append(*f, value)
 	return nil
 }
+
+// ByteSize is a number of bytes, that can be set from human readable values
+// like 512k, 5MB or 1g (units are powers of 1024).
+type ByteSize int64
+
+var byteUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"kb", 1 << 10}, {"k", 1 << 10}, {"kib", 1 << 10},
+	{"mb", 1 << 20}, {"m", 1 << 20}, {"mib", 1 << 20},
+	{"gb", 1 << 30}, {"g", 1 << 30}, {"gib", 1 << 30},
+	{"b", 1},
+}
+
+func (b *ByteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+// Set parses a human readable size.
+func (b *ByteSize) Set(value string) error {
+	v := strings.ToLower(strings.TrimSpace(value))
+	var multiplier int64 = 1
+	for _, u := range byteUnits {
+		if strings.HasSuffix(v, u.suffix) {
+			v, multiplier = strings.TrimSpace(strings.TrimSuffix(v, u.suffix)), u.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size: %s", value)
+	}
+	*b = ByteSize(n * float64(multiplier))
+	return nil
+}
@@ -2,52 +2,434 @@ package esbulk
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	errParseCannotServerAddr = errors.New("cannot parse server address")
+	errFieldNotFound         = errors.New("field not found")
 )
 
-var errParseCannotServerAddr = errors.New("cannot parse server address")
+// StatusError is returned, if elasticsearch responds with an error status.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("indexing failed with %d %s: %s",
+		e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
 
 // Options represents bulk indexing options.
 type Options struct {
-	Servers   []string
-	Host      string // deprecated: Use Servers.
-	Port      int    // deprecated: Use Servers.
-	Index     string
-	DocType   string
-	BatchSize int
-	Verbose   bool
-	IDField   string
-	Scheme    string // http or https; deprecated: Use Servers.
-	Username  string
-	Password  string
+	Servers         []string
+	Host            string // deprecated: Use Servers.
+	Port            int    // deprecated: Use Servers.
+	Index           string
+	DocType         string
+	Typeless        bool // Never send DocType and post to /{index}/_bulk, for elasticsearch 7 and later or opensearch.
+	CompactActions  bool // Post to /{index}/_bulk and omit _index and _type from actions, where they match, to save bytes.
+	BatchSize       int
+	Verbose         bool
+	IDField         string
+	Scheme          string // http or https; deprecated: Use Servers.
+	Username        string
+	Password        string
+	APIKey          string                 // Base64 encoded api key, used instead of basic auth.
+	Headers         http.Header            // Extra headers for every request, optional.
+	Retries         int                    // Retries on HTTP 429, 502, 503, 504 and connection errors.
+	RetryMaxWait    time.Duration          // Upper bound for the backoff between retries, default 30s.
+	FailFast        bool                   // Stop at the first document, that failed to index.
+	Pipeline        string                 // Ingest pipeline to use, optional.
+	BulkRefresh     string                 // Refresh parameter of bulk requests: false (default), true or wait_for.
+	RequestGzip     bool                   // Compress bulk request bodies with gzip.
+	BatchBytes      int64                  // Flush a batch, when its documents exceed this size, optional.
+	MaxRequestBytes int64                  // Upper bound for the body of a bulk request, larger documents are skipped, optional.
+	OpType          string                 // Bulk action, index (default), create, update or delete.
+	VersionField    string                 // Field to use as external version, optional.
+	VersionType     string                 // external (default) or external_gte.
+	VersionRequired bool                   // Fail on documents without a version.
+	IDTemplate      *template.Template     // Template to generate ids from documents, instead of IDField.
+	ActionTemplate  *template.Template     // Template to generate the action metadata, like {"_id": ...}, from documents, optional.
+	IDHash          bool                   // Use the SHA-1 of the document as id, instead of IDField.
+	SkipMissingID   bool                   // Skip documents, for which no id can be found, instead of failing.
+	AddFields       map[string]string      // Constant fields to add to each document.
+	TimestampField  string                 // Add the current time under this name to each document.
+	OverwriteFields bool                   // Overwrite existing fields with AddFields and TimestampField.
+	RenameFields    map[string]string      // Fields to rename, old to new name, in nested objects, too, optional.
+	FieldCase       string                 // Convert other field names to lower or snake case, optional.
+	FieldDepth      int                    // Levels of objects, whose fields RenameFields and FieldCase change, 0 for all.
+	DropFields      []string               // Fields not to index, as dotted paths, like a.b, optional.
+	KeepFields      []string               // Fields to index, as dotted paths, along with AddFields and TimestampField, optional.
+	IndexTemplate   *template.Template     // Template to compute the target index per document, optional.
+	IndexField      string                 // Field with the target index per document, like _index, optional.
+	FallbackIndex   string                 // Index for documents, for which IndexTemplate fails or without IndexField, defaults to Index.
+	Balancer        *Balancer              // Picks servers in round robin order, instead of at random, optional.
+	IndexSettings   map[string]interface{} // Settings for a newly created index, like number_of_shards, optional.
+	IndexMappings   json.RawMessage        // Mappings for a newly created index, optional.
+	Workers         int                    // Number of parallel workers used by Run, defaults to 1.
+	QueueSize       int                    // Documents Run reads ahead of the workers, default 0.
+	HTTPClient      *http.Client           // Client for all requests, defaults to http.DefaultClient. TLS (-cacert, -insecure) and proxy settings are ignored, if set.
+	Timeout         time.Duration          // Timeout for each request, including reading the response, optional.
+	DryRun          bool                   // Validate documents and build batches, but do not send them.
+	SkipInvalid     bool                   // Skip lines, that are not valid JSON, in Run, instead of failing.
+	ValidateJSON    bool                   // Fail on ndjson lines, that are not valid JSON, in Run, before sending them, implied by SkipInvalid.
+	AllowComments   bool                   // Ignore lines starting with #, in Run.
+	MaxLineBytes    int64                  // Longest ndjson or bulk line Run reads, longer lines fail or are skipped with SkipInvalid, bulk sources with their action, default any length.
+	InputFormat     string                 // Input format of Run, ndjson (default), json-array, csv, tsv or bulk.
+	CSVDelimiter    rune                   // Field delimiter for csv, defaults to comma, or tab for tsv.
+	CSVColumns      []string               // Field names for csv without a header row, optional.
+	CSVTyped        bool                   // Convert csv numbers and booleans, instead of using strings.
+	Limit           int64                  // Stop reading after this many documents in Run, optional.
+	Sample          float64                // Fraction of documents to index in Run, picked at random, optional.
+	Rand            *rand.Rand             // Random source for Sample, optional.
+	Offset          int64                  // Skip input up to this position in Run, to resume a load.
+	Checkpoint      func(pos int64)        // Called, when all input up to pos is indexed in Run, optional.
+	Progress        func(Stats)            // Called with the current stats during Run, optional.
+	ProgressEvery   time.Duration          // How often to call Progress.
+	OnBulk          BulkFunc               // Called after each bulk request attempt, optional.
+	DocLimiter      *rate.Limiter          // Limits the documents per second read by Run, optional.
+	ByteLimiter     *rate.Limiter          // Limits the bytes per second sent in bulk requests, optional.
+	Routing         string                 // Constant routing for all documents, optional.
+	RoutingField    string                 // Field to use as routing, optional, overrides Routing.
+	RoutingRequired bool                   // Fail on documents without a routing field.
+	JoinParentField string                 // Field with the parent id of child documents, used as routing.
+	DocAsUpsert     bool                   // Insert documents, that do not exist, with OpType update.
+	Adaptive        bool                   // Adapt the batch size of each worker, starting at BatchSize.
+	MinBatchSize    int                    // Lower bound for Adaptive, defaults to 1.
+	MaxBatchSize    int                    // Upper bound for Adaptive, defaults to ten times BatchSize.
+}
+
+// BulkFunc is called after each attempt to send a bulk request, with the
+// number of the attempt, starting at zero, the time it took and its error, if
+// any. It must be safe for concurrent use.
+type BulkFunc func(attempt int, took time.Duration, err error)
+
+// String returns the options for logging, with the password, api key, header
+// values and passwords in server URLs redacted.
+func (o Options) String() string {
+	const redacted = "xxxxx"
+	if o.Password != "" {
+		o.Password = redacted
+	}
+	if o.APIKey != "" {
+		o.APIKey = redacted
+	}
+	if o.Headers != nil {
+		headers := make(http.Header, len(o.Headers))
+		for k, values := range o.Headers {
+			for range values {
+				headers[k] = append(headers[k], redacted)
+			}
+		}
+		o.Headers = headers
+	}
+	servers := make([]string, len(o.Servers))
+	for i, s := range o.Servers {
+		servers[i] = s
+		if u, err := url.Parse(s); err == nil && u.User != nil {
+			servers[i] = u.Redacted()
+		}
+	}
+	o.Servers = servers
+	// Format without this method.
+	type options Options
+	return fmt.Sprintf("%v", options(o))
+}
+
+// server returns the next server from the balancer, if there is one, or
+// one of the configured servers at random.
+func (o Options) server() string {
+	if o.Balancer != nil {
+		return o.Balancer.Next()
+	}
+	return o.Servers[rand.Intn(len(o.Servers))]
+}
+
+// docType returns the document type to send, if any.
+func (o Options) docType() string {
+	if o.Typeless {
+		return ""
+	}
+	return o.DocType
+}
+
+// compact returns the action metadata without the index and type of the
+// request path, with CompactActions, so a plain action is just {"index":{}}.
+func (o Options) compact(meta actionMetadata) actionMetadata {
+	if !o.CompactActions {
+		return meta
+	}
+	if meta.Index == o.Index {
+		meta.Index = ""
+	}
+	if meta.Type == o.docType() {
+		meta.Type = ""
+	}
+	return meta
+}
+
+// Path joins segments into an absolute request path for NewRequest, escaping
+// each segment, so that any legal index or type name, like the date math name
+// <logs-{now/d}> or a name with a plus, ends up as a single segment:
+//
+//	options.NewRequest("GET", Path(options.Index, "_settings"), nil)
+func Path(segments ...string) string {
+	if len(segments) == 0 {
+		return "/"
+	}
+	var b strings.Builder
+	for _, s := range segments {
+		b.WriteString("/")
+		// PathEscape keeps plus signs, which elasticsearch decodes as
+		// spaces.
+		b.WriteString(strings.ReplaceAll(url.PathEscape(s), "+", "%2B"))
+	}
+	return b.String()
+}
+
+// NewRequest creates a request for a path on one of the servers, with
+// authorization, content type and any extra Headers set. Build paths with
+// Path, the server URL, including any path prefix, is prepended.
+func (o Options) NewRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, strings.TrimRight(o.server(), "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	o.SetAuth(req)
+	req.Header.Set("Content-Type", "application/json")
+	for k, values := range o.Headers {
+		for _, v := range values {
+			req.Header.Add(k, v)
+		}
+	}
+	return req, nil
+}
+
+// client returns the configured HTTP client or the default client.
+func (o Options) client() *http.Client {
+	if o.HTTPClient != nil {
+		return o.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// Do sends a request created with NewRequest. With a balancer, a server
+// failing with a connection error is skipped for a while and the request is
+// sent to the next server, if its body can be replayed.
+func (o Options) Do(req *http.Request) (*http.Response, error) {
+	resp, err := o.send(req)
+	if err == nil || o.Balancer == nil || req.Context().Err() != nil {
+		return resp, err
+	}
+	for i := 1; i < o.Balancer.Len(); i++ {
+		server, path := o.splitURL(req.URL.String())
+		if server == "" || (req.Body != nil && req.GetBody == nil) {
+			return nil, err
+		}
+		o.Balancer.MarkDown(server)
+		next := o.Balancer.Next()
+		if o.Verbose {
+			log.Printf("trying %s: %v", next, err)
+		}
+		u, perr := url.Parse(strings.TrimRight(next, "/") + path)
+		if perr != nil {
+			return nil, perr
+		}
+		retry := req.Clone(req.Context())
+		retry.URL, retry.Host = u, ""
+		if req.GetBody != nil {
+			if retry.Body, perr = req.GetBody(); perr != nil {
+				return nil, perr
+			}
+		}
+		if resp, err = o.send(retry); err == nil {
+			return resp, nil
+		}
+		req = retry
+	}
+	return nil, err
+}
+
+// send sends a single request, which must complete within Timeout, if set,
+// including reading the response body.
+func (o Options) send(req *http.Request) (*http.Response, error) {
+	if o.Timeout <= 0 {
+		return o.client().Do(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), o.Timeout)
+	resp, err := o.client().Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelReadCloser{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelReadCloser releases a context, when the body is closed.
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r *cancelReadCloser) Close() error {
+	defer r.cancel()
+	return r.ReadCloser.Close()
+}
+
+// splitURL splits a request URL into the server it was created for and the
+// path, including any query.
+func (o Options) splitURL(s string) (server, path string) {
+	for _, v := range o.Servers {
+		prefix := strings.TrimRight(v, "/")
+		if strings.HasPrefix(s, prefix+"/") {
+			return v, s[len(prefix):]
+		}
+	}
+	return "", ""
+}
+
+// SetAuth adds authorization to a request, using either the api key or basic
+// auth, if configured.
+func (o Options) SetAuth(req *http.Request) {
+	switch {
+	case o.APIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+o.APIKey)
+	case o.Username != "" && o.Password != "":
+		req.SetBasicAuth(o.Username, o.Password)
+	}
+}
+
+// ItemResult is the outcome of a single bulk action.
+type ItemResult struct {
+	Index  string    `json:"_index"`
+	Type   string    `json:"_type"`
+	ID     string    `json:"_id"`
+	Status int       `json:"status"`
+	Result string    `json:"result"`
+	Error  ItemError `json:"error"`
+}
+
+// ItemError describes why a bulk action failed.
+type ItemError struct {
+	Type      string `json:"type"`
+	Reason    string `json:"reason"`
+	IndexUUID string `json:"index_uuid"`
+	Shard     string `json:"shard"`
+	Index     string `json:"index"`
+	CausedBy  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"caused_by,omitempty"`
+}
+
+// UnmarshalJSON accepts an error object, as well as a plain string, which
+// older elasticsearch versions and some OpenSearch responses use.
+func (e *ItemError) UnmarshalJSON(b []byte) error {
+	var reason string
+	if err := json.Unmarshal(b, &reason); err == nil {
+		*e = ItemError{Type: "error", Reason: reason}
+		return nil
+	}
+	type itemError ItemError // Avoid recursion.
+	var v itemError
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*e = ItemError(v)
+	if e.Reason == "" && e.CausedBy != nil {
+		e.Type, e.Reason = e.CausedBy.Type, e.CausedBy.Reason
+	}
+	return nil
+}
+
+// Failed returns true, if the action was not successful. Deleting a missing
+// document is not considered a failure.
+func (r ItemResult) Failed() bool {
+	if r.Result == "not_found" && r.Error.Type == "" {
+		return false
+	}
+	return r.Status >= 400 || r.Error.Type != ""
 }
 
 // Item represents a bulk action.
 type Item struct {
-	IndexAction struct {
-		Index  string `json:"_index"`
-		Type   string `json:"_type"`
-		ID     string `json:"_id"`
-		Status int    `json:"status"`
-		Error  struct {
-			Type      string `json:"type"`
-			Reason    string `json:"reason"`
-			IndexUUID string `json:"index_uuid"`
-			Shard     string `json:"shard"`
-			Index     string `json:"index"`
-		} `json:"error"`
-	} `json:"index"`
+	IndexAction  ItemResult `json:"index"`
+	CreateAction ItemResult `json:"create"`
+	DeleteAction ItemResult `json:"delete"`
+	UpdateAction ItemResult `json:"update"`
+}
+
+// Result returns the result of the action, regardless of its type.
+func (item Item) Result() ItemResult {
+	if item.CreateAction.Status != 0 {
+		return item.CreateAction
+	}
+	if item.DeleteAction.Status != 0 {
+		return item.DeleteAction
+	}
+	if item.UpdateAction.Status != 0 {
+		return item.UpdateAction
+	}
+	return item.IndexAction
+}
+
+// ItemsError is returned, if some documents of a bulk request could not be
+// indexed, while the request itself succeeded.
+type ItemsError struct {
+	Failed int
+	Total  int
+}
+
+func (e *ItemsError) Error() string {
+	return fmt.Sprintf("error during bulk operation, %d of %d docs failed, try less workers (lower -w value) or increase thread_pool.bulk.queue_size in your nodes", e.Failed, e.Total)
+}
+
+// BatchError is returned or reported by a worker, if a batch could not be
+// indexed.
+type BatchError struct {
+	Worker     string // Name of the worker.
+	Batch      int    // Number of the batch within the worker, starting at 1.
+	Docs       int    // Number of documents in the batch.
+	StatusCode int    // HTTP status code, if the server responded with an error.
+	Payload    string // Abbreviated first document of the batch.
+	Err        error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%s: batch %d with %d docs failed: %v", e.Worker, e.Batch, e.Docs, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *BatchError) Unwrap() error {
+	return e.Err
 }
 
 // BulkResponse is a response to a bulk request.
@@ -57,164 +439,755 @@ type BulkResponse struct {
 	Items     []Item `json:"items"`
 }
 
-// SetServer parses out host and port for a string and sets the option values.
+// SetServer parses out scheme, host and port for a server URL, like
+// http://[::1]:9200 or https://proxy/es, and sets the option values. Without
+// a port, the port is the default of the scheme, which is also used for
+// requests. A path, like /es, is part of the server URL and so of all request
+// paths already.
 func (o *Options) SetServer(s string) error {
 	locator, err := url.Parse(s)
 	if err != nil {
 		return err
 	}
+	if locator.Host == "" {
+		return errParseCannotServerAddr
+	}
 	o.Scheme = locator.Scheme
-	parts := strings.Split(locator.Host, ":")
-	switch len(parts) {
-	case 1:
-		log.Println(s, locator.Host, parts)
-		// Assume port, like https://:9200.
-		port, err := strconv.Atoi(parts[0])
+	o.Host = locator.Hostname()
+	switch p := locator.Port(); {
+	case p != "":
+		port, err := strconv.Atoi(p)
 		if err != nil {
 			return err
 		}
 		o.Port = port
-	case 2:
-		o.Host = parts[0]
-		port, err := strconv.Atoi(parts[1])
+	case o.Scheme == "https":
+		o.Port = 443
+	default:
+		o.Port = 80
+	}
+	return nil
+}
+
+// Validate checks the options for values, that would fail later or cannot
+// work at all, like an empty index or an unparseable server.
+func (o Options) Validate() error {
+	if o.Index == "" {
+		return errors.New("index name required")
+	}
+	if o.BatchSize <= 0 {
+		return fmt.Errorf("batch size must be positive, got %d", o.BatchSize)
+	}
+	if o.Workers < 0 {
+		return fmt.Errorf("number of workers must not be negative, got %d", o.Workers)
+	}
+	if o.QueueSize < 0 {
+		return fmt.Errorf("queue size must not be negative, got %d", o.QueueSize)
+	}
+	if len(o.Servers) == 0 {
+		return errors.New("at least one server required")
+	}
+	for _, s := range o.Servers {
+		u, err := url.Parse(s)
 		if err != nil {
-			return err
+			return fmt.Errorf("invalid server %s: %v", s, err)
 		}
-		o.Port = port
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("invalid server %s: scheme must be http or https", s)
+		}
+		if u.Host == "" {
+			return fmt.Errorf("invalid server %s: missing host", s)
+		}
+	}
+	switch o.Scheme {
+	case "", "http", "https":
 	default:
-		return errParseCannotServerAddr
+		return fmt.Errorf("unknown scheme: %s", o.Scheme)
+	}
+	switch o.OpType {
+	case "", "index", "create", "update", "delete":
+	default:
+		return fmt.Errorf("unknown op type: %s", o.OpType)
+	}
+	if o.ActionTemplate != nil && (o.IDField != "" || o.IDTemplate != nil || o.IDHash || o.VersionField != "" ||
+		o.IndexTemplate != nil || o.IndexField != "" || o.RoutingField != "" || o.JoinParentField != "" || o.Routing != "") {
+		return errors.New("action template cannot be combined with ids, routing, versions or index templates or fields, it sets them itself")
+	}
+	switch o.FieldCase {
+	case "", "lower", "snake":
+	default:
+		return fmt.Errorf("unknown field case: %s", o.FieldCase)
+	}
+	if len(o.DropFields) > 0 && len(o.KeepFields) > 0 {
+		return errors.New("drop and keep fields are mutually exclusive")
+	}
+	if o.FieldDepth < 0 {
+		return fmt.Errorf("field depth must not be negative, got %d", o.FieldDepth)
+	}
+	switch o.BulkRefresh {
+	case "", "false", "true", "wait_for":
+	default:
+		return fmt.Errorf("unknown bulk refresh: %s", o.BulkRefresh)
+	}
+	switch o.VersionType {
+	case "", "external", "external_gte":
+	default:
+		return fmt.Errorf("unknown version type: %s", o.VersionType)
+	}
+	switch o.InputFormat {
+	case "", "ndjson", "json-array", "csv", "tsv":
+	case "bulk":
+		if o.rewritesActions() {
+			return errors.New("bulk input is sent as is, it cannot be combined with ids, routing, versions, index templates or fields, added, renamed or dropped fields or another op type")
+		}
+	default:
+		return fmt.Errorf("unknown input format: %s", o.InputFormat)
+	}
+	if o.Sample < 0 || o.Sample > 1 {
+		return fmt.Errorf("sample must be between 0 and 1, got %v", o.Sample)
 	}
 	return nil
 }
 
-// nestedStr handles the nested JSON values.
-func nestedStr(tokstr []string, docmap map[string]interface{}, currentID string) interface{} {
-	thistok := tokstr[0]
-	tempStr2, ok := docmap[thistok].(map[string]interface{})
-	if !ok {
-		return nil
+// actionMetadata is the metadata line of a bulk action.
+type actionMetadata struct {
+	Index       string      `json:"_index,omitempty"`
+	Type        string      `json:"_type,omitempty"`
+	ID          string      `json:"_id,omitempty"`
+	Routing     string      `json:"routing,omitempty"`
+	Version     json.Number `json:"version,omitempty"`
+	VersionType string      `json:"version_type,omitempty"`
+}
+
+// lookupField finds a value in a document by name, where nested fields are
+// separated by dots, like "a.b". Arrays along the path are not supported.
+func lookupField(docmap map[string]interface{}, name string) (interface{}, error) {
+	var v interface{} = docmap
+	keys := strings.Split(name, ".")
+	for i, key := range keys {
+		switch m := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = m[key]; !ok {
+				return nil, errFieldNotFound
+			}
+		case []interface{}:
+			return nil, fmt.Errorf("field %s is an array, which is not supported",
+				strings.Join(keys[:i], "."))
+		default:
+			return nil, errFieldNotFound
+		}
 	}
-	var TokenVal interface{}
-	var ok1 bool
-	TokenVal = tempStr2
-	for count3 := 1; count3 < len(tokstr); count3++ {
-		thistok = tokstr[count3]
-		TokenVal, ok1 = tempStr2[thistok]
-		if !ok1 {
-			return nil
+	return v, nil
+}
+
+// versionString returns the string representation of a version, which must
+// be a non-negative integer.
+func versionString(v interface{}) (string, error) {
+	var s string
+	switch t := v.(type) {
+	case json.Number:
+		s = t.String()
+	case string:
+		s = t
+	default:
+		return "", fmt.Errorf("not a number: %v", v)
+	}
+	if _, err := strconv.ParseUint(s, 10, 64); err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+// rewritesActions returns true, if options change the action or source of
+// documents, which is not possible for bulk input.
+func (o Options) rewritesActions() bool {
+	return o.IDField != "" || o.IDTemplate != nil || o.IDHash || o.VersionField != "" ||
+		len(o.AddFields) > 0 || o.TimestampField != "" || o.IndexTemplate != nil || o.IndexField != "" ||
+		o.RoutingField != "" || o.JoinParentField != "" || o.Routing != "" || o.ActionTemplate != nil ||
+		o.renamesFields() || o.prunesFields() || (o.OpType != "" && o.OpType != "index")
+}
+
+// decodeDocuments returns true, if documents need to be decoded, before they
+// can be indexed.
+func (o Options) decodeDocuments() bool {
+	return o.DryRun || o.IDField != "" || o.IDTemplate != nil || o.IDHash || o.VersionField != "" ||
+		len(o.AddFields) > 0 || o.TimestampField != "" || o.IndexTemplate != nil || o.IndexField != "" ||
+		o.RoutingField != "" || o.JoinParentField != "" || o.ActionTemplate != nil || o.renamesFields() || o.prunesFields()
+}
+
+// renamesFields returns true, if field names of documents are changed.
+func (o Options) renamesFields() bool {
+	return len(o.RenameFields) > 0 || o.FieldCase != ""
+}
+
+// prunesFields returns true, if fields are dropped from documents.
+func (o Options) prunesFields() bool {
+	return len(o.DropFields) > 0 || len(o.KeepFields) > 0
+}
+
+// documentRouting returns the routing for a document from RoutingField, or
+// the constant Routing, if the document has no such field and RoutingRequired
+// is not set.
+func documentRouting(docmap map[string]interface{}, options Options) (string, error) {
+	if options.JoinParentField != "" {
+		return joinRouting(docmap, options)
+	}
+	if options.RoutingField == "" {
+		return options.Routing, nil
+	}
+	v, err := lookupField(docmap, options.RoutingField)
+	if err == errFieldNotFound && !options.RoutingRequired {
+		return options.Routing, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("document has no routing field (%s): %v", options.RoutingField, err)
+	}
+	switch t := v.(type) {
+	case string:
+		return t, nil
+	case json.Number:
+		return t.String(), nil
+	default:
+		return "", fmt.Errorf("invalid routing (%s): not a string or number: %v", options.RoutingField, v)
+	}
+}
+
+// setField sets a top level field in a document, existing fields are only
+// overwritten, if requested. Returns true, if the document was changed.
+func setField(docmap map[string]interface{}, key string, value interface{}, overwrite bool) bool {
+	if _, ok := docmap[key]; ok && !overwrite {
+		return false
+	}
+	docmap[key] = value
+	return true
+}
+
+// marshalDocument serializes a decoded document, without escaping HTML.
+func marshalDocument(docmap map[string]interface{}) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(docmap); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// documentIndex returns the target index for a document from its IndexField
+// or by executing the IndexTemplate; if the document has no such field or the
+// template fails, the FallbackIndex or Index is used.
+func documentIndex(docmap map[string]interface{}, options Options) (string, error) {
+	if options.IndexField != "" {
+		v, err := lookupField(docmap, options.IndexField)
+		switch {
+		case err == errFieldNotFound:
+		case err != nil:
+			return "", err
+		default:
+			index, ok := v.(string)
+			if !ok {
+				return "", fmt.Errorf("index field %s is not a string: %v", options.IndexField, v)
+			}
+			if index != "" {
+				return index, nil
+			}
 		}
-		if count3 < len(tokstr)-1 {
-			tempStr2 = TokenVal.(map[string]interface{})
+	} else {
+		var buf bytes.Buffer
+		if err := options.IndexTemplate.Execute(&buf, docmap); err == nil && buf.Len() > 0 {
+			return buf.String(), nil
 		}
 	}
-	return TokenVal
+	if options.FallbackIndex != "" {
+		return options.FallbackIndex, nil
+	}
+	return options.Index, nil
+}
+
+// isIDFieldSep separates multiple fields to be concatenated into an id.
+func isIDFieldSep(r rune) bool { return r == ',' || r == ' ' }
 
+// documentID returns the id of a document, either from the concatenated
+// values of IDField, by executing IDTemplate on the document or, with IDHash,
+// as hash of its content.
+func documentID(docmap map[string]interface{}, options Options) (string, error) {
+	if options.IDHash {
+		// Map keys are sorted when marshalled and numbers keep their text,
+		// so equal documents get the same id, regardless of key order.
+		b, err := marshalDocument(docmap)
+		if err != nil {
+			return "", err
+		}
+		sum := sha1.Sum([]byte(b))
+		return hex.EncodeToString(sum[:]), nil
+	}
+	if options.IDTemplate != nil {
+		var buf bytes.Buffer
+		if err := options.IDTemplate.Execute(&buf, docmap); err != nil {
+			return "", fmt.Errorf("cannot execute id template: %v", err)
+		}
+		// An empty id would let elasticsearch generate one, so it counts as
+		// missing.
+		if buf.Len() == 0 {
+			return "", errors.New("id template returned an empty id")
+		}
+		return buf.String(), nil
+	}
+	id := strings.FieldsFunc(options.IDField, isIDFieldSep)
+	// ID can be any type at this point, try to find a string
+	// representation or bail out.
+	var idstr string
+	var currentID string
+	for counter := range id {
+		currentID = id[counter]
+		// Nested fields are separated by dots, like "meta.id".
+		TokenVal, err := lookupField(docmap, currentID)
+		if err != nil {
+			return "", fmt.Errorf("document has no ID field (%s): %v", currentID, err)
+		}
+		switch tempStr1 := interface{}(TokenVal).(type) {
+		case string:
+			idstr = idstr + tempStr1
+		case fmt.Stringer:
+			idstr = idstr + tempStr1.String()
+		case json.Number:
+			idstr = idstr + tempStr1.String()
+		default:
+			return "", fmt.Errorf("cannot convert id value to string")
+		}
+	}
+	return idstr, nil
+}
+
+// joinRouting returns the parent id of a child document as routing, so it is
+// stored on the shard of its parent. The JoinParentField names the parent id,
+// usually the parent of a join field, like "my_join.parent". Parent documents
+// have no parent id and are routed by their id, as usual.
+func joinRouting(docmap map[string]interface{}, options Options) (string, error) {
+	v, err := lookupField(docmap, options.JoinParentField)
+	if err == errFieldNotFound {
+		return options.Routing, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid join field (%s): %v", options.JoinParentField, err)
+	}
+	switch t := v.(type) {
+	case string:
+		return t, nil
+	case json.Number:
+		return t.String(), nil
+	default:
+		return "", fmt.Errorf("invalid parent id (%s): not a string or number: %v", options.JoinParentField, v)
+	}
+}
+
+// actionSource returns the source line of a bulk action for a document: the
+// document itself for index and create, wrapped as a partial document for
+// update.
+func actionSource(opType, doc string, options Options) (string, error) {
+	switch opType {
+	case "update":
+		b, err := json.Marshal(struct {
+			Doc         json.RawMessage `json:"doc"`
+			DocAsUpsert bool            `json:"doc_as_upsert,omitempty"`
+		}{json.RawMessage(doc), options.DocAsUpsert})
+		if err != nil {
+			return "", fmt.Errorf("invalid document: %v: %s", err, abbreviate(doc, 256))
+		}
+		return string(b), nil
+	default:
+		return doc, nil
+	}
+}
+
+// deleteID returns the id to delete for a line, which is either a JSON object,
+// with the id taken from IDField or IDTemplate, or a plain or JSON string id.
+// For objects, IndexField or IndexTemplate may set the index of the action.
+func deleteID(line string, meta *actionMetadata, options Options) (string, error) {
+	line = strings.TrimSpace(line)
+	switch {
+	case strings.HasPrefix(line, "{"):
+		if options.IDField == "" && options.IDTemplate == nil && !options.IDHash {
+			return "", errors.New("delete needs an id field, template or hash for JSON documents")
+		}
+		var docmap map[string]interface{}
+		dec := json.NewDecoder(strings.NewReader(line))
+		dec.UseNumber()
+		if err := dec.Decode(&docmap); err != nil {
+			return "", fmt.Errorf("invalid document: %v", err)
+		}
+		if options.IndexTemplate != nil || options.IndexField != "" {
+			index, err := documentIndex(docmap, options)
+			if err != nil {
+				return "", err
+			}
+			meta.Index = index
+		}
+		routing, err := documentRouting(docmap, options)
+		if err != nil {
+			return "", err
+		}
+		meta.Routing = routing
+		return documentID(docmap, options)
+	case strings.HasPrefix(line, `"`):
+		var id string
+		if err := json.Unmarshal([]byte(line), &id); err != nil {
+			return "", fmt.Errorf("invalid id: %v", err)
+		}
+		if id == "" {
+			return "", errors.New("empty id")
+		}
+		return id, nil
+	default:
+		return line, nil
+	}
 }
 
 // BulkIndex takes a set of documents as strings and indexes them into elasticsearch.
 func BulkIndex(docs []string, options Options) error {
-	if len(docs) == 0 {
-		return nil
+	return BulkIndexContext(context.Background(), docs, options)
+}
+
+// BulkIndexContext is like BulkIndex, but cancelling the context aborts
+// outstanding requests and retries.
+func BulkIndexContext(ctx context.Context, docs []string, options Options) error {
+	_, err := bulkIndex(ctx, docs, nil, options)
+	return err
+}
+
+// BulkRequest returns the path and body of the bulk request, that BulkIndex
+// sends for documents, without sending it, so the exact bytes can be checked,
+// e.g. in tests, along with the number of documents skipped, like those
+// without an id with SkipMissingID. The body is not compressed, even with
+// RequestGzip, and it is empty, if there is nothing to send.
+func BulkRequest(docs []string, options Options) (path string, body []byte, skipped int, err error) {
+	path, b, skipped, err := bulkRequest(docs, nil, options)
+	return path, []byte(b), skipped, err
+}
+
+// bulkRequest builds a bulk request and returns its path, its body and the
+// number of documents skipped. If where is not nil, it returns the position
+// of a document in the input, like "line 12", for error messages.
+func bulkRequest(docs []string, where func(i int) string, options Options) (path, body string, skipped int, err error) {
+	path = Path("_bulk")
+	switch {
+	case options.CompactActions && options.docType() != "":
+		path = Path(options.Index, options.docType(), "_bulk")
+	case options.InputFormat == "bulk" || options.Typeless || options.CompactActions:
+		// Actions without an _index go to the Index.
+		path = Path(options.Index, "_bulk")
+	}
+	params := url.Values{}
+	if options.Pipeline != "" {
+		params.Set("pipeline", options.Pipeline)
+	}
+	if options.BulkRefresh != "" && options.BulkRefresh != "false" {
+		params.Set("refresh", options.BulkRefresh)
+	}
+	if len(params) > 0 {
+		path += "?" + params.Encode()
+	}
+
+	opType := options.OpType
+	if opType == "" {
+		opType = "index"
 	}
 
-	rand.Seed(time.Now().Unix())
-	server := options.Servers[rand.Intn(len(options.Servers))]
-	link := fmt.Sprintf("%s/_bulk", server)
+	now := time.Now().Format(time.RFC3339)
+
+	// at prefixes an error message with the position of a document.
+	at := func(i int) string {
+		if where == nil {
+			return ""
+		}
+		return where(i) + ": "
+	}
 
 	var lines []string
-	for _, doc := range docs {
+	for i, doc := range docs {
 		if len(strings.TrimSpace(doc)) == 0 {
 			continue
 		}
 
-		header := fmt.Sprintf(`{"index": {"_index": "%s", "_type": "%s"}}`, options.Index, options.DocType)
+		// Bulk input already consists of action and source lines.
+		if options.InputFormat == "bulk" {
+			lines = append(lines, doc)
+			continue
+		}
+
+		meta := actionMetadata{Index: options.Index, Type: options.docType(), Routing: options.Routing}
 
-		// If an "-id" is given, peek into the document to extract the ID and
-		// use it in the header.
-		if options.IDField != "" {
+		// Deletes have no document, only an id.
+		if opType == "delete" && options.ActionTemplate != nil {
 			var docmap map[string]interface{}
 			dec := json.NewDecoder(strings.NewReader(doc))
 			dec.UseNumber()
 			if err := dec.Decode(&docmap); err != nil {
-				return err
+				return "", "", 0, fmt.Errorf("%sinvalid document: %v: %s", at(i), err, abbreviate(doc, 256))
 			}
-
-			idstring := options.IDField //A delimiter separates string with all the fields to be used as ID
-			id := strings.FieldsFunc(idstring, func(r rune) bool { return r == ',' || r == ' ' })
-			// ID can be any type at this point, try to find a string
-			// representation or bail out.
-			var idstr string
-			var currentID string
-			for counter := range id {
-				currentID = id[counter]
-				tokstr := strings.Split(currentID, ".")
-				var TokenVal interface{}
-				if len(tokstr) > 1 {
-					TokenVal = nestedStr(tokstr, docmap, currentID)
-					if TokenVal == nil {
-						return fmt.Errorf("document has no ID field (%s): %s", currentID, doc)
-					}
-				} else {
-					var ok2 bool
-					TokenVal, ok2 = docmap[currentID]
-					if !ok2 {
-						return fmt.Errorf("document has no ID field (%s): %s", currentID, doc)
-					}
+			header, err := templateAction(docmap, opType, options)
+			if err != nil {
+				return "", "", 0, fmt.Errorf("%s%v: %s", at(i), err, abbreviate(doc, 256))
+			}
+			lines = append(lines, header)
+			continue
+		}
+		if opType == "delete" {
+			id, err := deleteID(doc, &meta, options)
+			if err != nil {
+				if !options.SkipMissingID {
+					return "", "", 0, fmt.Errorf("%s%v: %s", at(i), err, abbreviate(doc, 256))
 				}
-				switch tempStr1 := interface{}(TokenVal).(type) {
-				case string:
-					idstr = idstr + tempStr1
-				case fmt.Stringer:
-					idstr = idstr + tempStr1.String()
-				case json.Number:
-					idstr = idstr + tempStr1.String()
-				default:
-					return fmt.Errorf("cannot convert id value to string")
+				log.Printf("skipping document: %s%v: %s", at(i), err, abbreviate(doc, 256))
+				skipped++
+				continue
+			}
+			meta.ID = id
+			header, err := json.Marshal(map[string]actionMetadata{opType: options.compact(meta)})
+			if err != nil {
+				return "", "", 0, err
+			}
+			lines = append(lines, string(header))
+			continue
+		}
+
+		// Peek into the document, if we need values from it for the header
+		// or want to modify it.
+		var docmap map[string]interface{}
+		var modified bool
+		if options.decodeDocuments() {
+			dec := json.NewDecoder(strings.NewReader(doc))
+			dec.UseNumber()
+			if err := dec.Decode(&docmap); err != nil {
+				return "", "", 0, fmt.Errorf("%sinvalid document: %v: %s", at(i), err, abbreviate(doc, 256))
+			}
+			if dec.More() {
+				return "", "", 0, fmt.Errorf("%sinvalid document: unexpected data after object: %s", at(i), abbreviate(doc, 256))
+			}
+		}
+
+		// Rename fields first, so all other options refer to the new names.
+		if options.renamesFields() {
+			changed, err := renameFields(docmap, options)
+			if err != nil {
+				return "", "", 0, fmt.Errorf("%s%v: %s", at(i), err, abbreviate(doc, 256))
+			}
+			modified = changed
+		}
+
+		// Route documents to an index given by a field or template, or
+		// fallback. A metadata field, like _index, cannot be part of the
+		// document.
+		if options.IndexTemplate != nil || options.IndexField != "" {
+			index, err := documentIndex(docmap, options)
+			if err != nil {
+				return "", "", 0, fmt.Errorf("%s%v: %s", at(i), err, abbreviate(doc, 256))
+			}
+			meta.Index = index
+			if strings.HasPrefix(options.IndexField, "_") {
+				if _, ok := docmap[options.IndexField]; ok {
+					delete(docmap, options.IndexField)
+					modified = true
 				}
 			}
+		}
+		if options.RoutingField != "" || options.JoinParentField != "" {
+			routing, err := documentRouting(docmap, options)
+			if err != nil {
+				return "", "", 0, fmt.Errorf("%s%v: %s", at(i), err, abbreviate(doc, 256))
+			}
+			meta.Routing = routing
+		}
 
-			header = fmt.Sprintf(`{"index": {"_index": "%s", "_type": "%s", "_id": %q}}`,
-				options.Index, options.DocType, idstr)
+		// If an "-id", id template or hash is given, use the ID in the header.
+		if options.IDField != "" || options.IDTemplate != nil || options.IDHash {
+			id, err := documentID(docmap, options)
+			if err != nil {
+				if !options.SkipMissingID {
+					return "", "", 0, fmt.Errorf("%s%v: %s", at(i), err, abbreviate(doc, 256))
+				}
+				log.Printf("skipping document: %s%v: %s", at(i), err, abbreviate(doc, 256))
+				skipped++
+				continue
+			}
+			meta.ID = id
+		}
 
-			// Remove the IDField if it is accidentally named '_id', since
-			// Field [_id] is a metadata field and cannot be added inside a
-			// document.
+		// Remove the IDField if it is accidentally named '_id', since
+		// Field [_id] is a metadata field and cannot be added inside a
+		// document.
+		if options.IDField != "" {
 			var flag int // 0 by default
-			for count := range id {
-				if id[count] == "_id" {
+			for _, f := range strings.FieldsFunc(options.IDField, isIDFieldSep) {
+				if f == "_id" {
 					flag = 1 // Check if any of the id fields to be concatenated is named '_id'.
 				}
 			}
 
 			if flag == 1 {
 				delete(docmap, "_id")
-				b, err := json.Marshal(docmap)
+				modified = true
+			}
+		}
+
+		// Add constant fields and timestamp.
+		if len(options.AddFields) > 0 || options.TimestampField != "" {
+			for k, v := range options.AddFields {
+				modified = setField(docmap, k, v, options.OverwriteFields) || modified
+			}
+			if options.TimestampField != "" {
+				modified = setField(docmap, options.TimestampField, now, options.OverwriteFields) || modified
+			}
+		}
+
+		// Fields are dropped only from the indexed copy, so a version field,
+		// for example, need not be indexed.
+		indexed := docmap
+		if options.prunesFields() {
+			indexed, modified = pruneFields(docmap, options), true
+		}
+		if modified {
+			b, err := marshalDocument(indexed)
+			if err != nil {
+				return "", "", 0, err
+			}
+			doc = b
+		}
+
+		// Use an external version, documents without a version are indexed
+		// without one, unless a version is required.
+		if options.VersionField != "" {
+			v, err := lookupField(docmap, options.VersionField)
+			switch {
+			case err == nil:
+				version, err := versionString(v)
 				if err != nil {
-					return err
+					return "", "", 0, fmt.Errorf("%sinvalid version (%s): %v: %s", at(i), options.VersionField, err, abbreviate(doc, 256))
+				}
+				meta.Version = json.Number(version)
+				meta.VersionType = options.VersionType
+				if meta.VersionType == "" {
+					meta.VersionType = "external"
 				}
-				doc = string(b)
+			case err != errFieldNotFound || options.VersionRequired:
+				return "", "", 0, fmt.Errorf("%sdocument has no version field (%s): %v: %s", at(i), options.VersionField, err, abbreviate(doc, 256))
+			}
+		}
+
+		var header string
+		if options.ActionTemplate != nil {
+			if header, err = templateAction(docmap, opType, options); err != nil {
+				return "", "", 0, fmt.Errorf("%s%v: %s", at(i), err, abbreviate(doc, 256))
+			}
+		} else {
+			if opType == "update" && meta.ID == "" {
+				return "", "", 0, fmt.Errorf("%supdate requires an id: %s", at(i), abbreviate(doc, 256))
+			}
+			b, err := json.Marshal(map[string]actionMetadata{opType: options.compact(meta)})
+			if err != nil {
+				return "", "", 0, err
 			}
+			header = string(b)
+		}
+		source, err := actionSource(opType, doc, options)
+		if err != nil {
+			return "", "", 0, fmt.Errorf("%s%v", at(i), err)
 		}
 		lines = append(lines, header)
-		lines = append(lines, doc)
+		lines = append(lines, source)
 	}
 
-	body := fmt.Sprintf("%s\n", strings.Join(lines, "\n"))
+	if len(lines) == 0 {
+		return path, "", skipped, nil
+	}
+	return path, fmt.Sprintf("%s\n", strings.Join(lines, "\n")), skipped, nil
+}
 
+// bulkIndex indexes documents and returns the number of bytes sent. The
+// positions of documents, if known, are reported by where, as in bulkRequest.
+func bulkIndex(ctx context.Context, docs []string, where func(i int) string, options Options) (sent int, err error) {
+	if len(docs) == 0 {
+		return 0, nil
+	}
+	path, body, skipped, err := bulkRequest(docs, where, options)
+	if err != nil {
+		return 0, err
+	}
+	if body == "" {
+		return 0, addSkipped(nil, skipped, len(docs))
+	}
+
+	payload := []byte(body)
+	if options.RequestGzip {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := io.WriteString(zw, body); err != nil {
+			return 0, err
+		}
+		if err := zw.Close(); err != nil {
+			return 0, err
+		}
+		payload = buf.Bytes()
+	}
+	if options.DryRun {
+		return len(payload), addSkipped(nil, skipped, len(docs))
+	}
+
+	// Retry on temporary failures, like too many requests or connection
+	// errors, with exponential backoff.
+	for attempt := 0; ; attempt++ {
+		if err := waitN(ctx, options.ByteLimiter, len(payload)); err != nil {
+			return 0, err
+		}
+		started := time.Now()
+		err := postBulk(ctx, path, payload, options)
+		if options.OnBulk != nil {
+			options.OnBulk(attempt, time.Since(started), err)
+		}
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		if err == nil || !isRetryable(ctx, err) {
+			return len(payload), addSkipped(err, skipped, len(docs))
+		}
+		if attempt >= options.Retries {
+			return 0, fmt.Errorf("giving up after %d attempts, %d docs not indexed (%s): %w",
+				attempt+1, len(docs), abbreviate(body, 256), err)
+		}
+		wait := backoff(attempt, options.RetryMaxWait)
+		if options.Verbose {
+			log.Printf("retrying in %s: %v", wait, err)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// postBulk sends a single bulk request body to a path, the body is expected
+// to be gzip compressed, if RequestGzip is set.
+func postBulk(ctx context.Context, path string, body []byte, options Options) error {
 	// There are multiple ways indexing can fail, e.g. connection errors or
 	// bad requests. Finally, if we have a HTTP 200, the bulk request could
 	// still have failed: for that we need to decode the elasticsearch
 	// response.
-	req, err := http.NewRequest("POST", link, strings.NewReader(body))
+	req, err := options.NewRequest("POST", path, bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
-
-	if options.Username != "" && options.Password != "" {
-		req.SetBasicAuth(options.Username, options.Password)
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if options.RequestGzip {
+		req.Header.Set("Content-Encoding", "gzip")
 	}
-	req.Header.Set("Content-Type", "application/json")
-	response, err := http.DefaultClient.Do(req)
+	// With a debug log level, the status and item counts of each response
+	// are logged, to see how a partially failing load goes.
+	debug := slog.Default().Enabled(ctx, slog.LevelDebug)
+	started := time.Now()
+	response, err := options.Do(req)
 	if err != nil {
 		return err
 	}
@@ -225,84 +1198,427 @@ func BulkIndex(docs []string, options Options) error {
 		if _, err := io.Copy(&buf, response.Body); err != nil {
 			return err
 		}
-		return fmt.Errorf("indexing failed with %d %s: %s",
-			response.StatusCode, http.StatusText(response.StatusCode), buf.String())
+		if debug {
+			slog.Debug("bulk response", "path", path, "status", response.StatusCode, "took", time.Since(started))
+		}
+		return &StatusError{StatusCode: response.StatusCode, Body: buf.String()}
 	}
 
 	var br BulkResponse
 	if err := json.NewDecoder(response.Body).Decode(&br); err != nil {
 		return err
 	}
-	if br.HasErrors {
+	if !br.HasErrors {
+		if debug {
+			slog.Debug("bulk response", "path", path, "status", response.StatusCode,
+				"items", len(br.Items), "failed", 0, "took", time.Since(started))
+		}
+		return nil
+	}
+	var failed int
+	for _, item := range br.Items {
+		result := item.Result()
+		if !result.Failed() {
+			continue
+		}
+		failed++
+		switch {
+		case options.Verbose && failedItemLog.allow():
+			log.Printf("failed to index doc %q (%d): %s: %s",
+				result.ID, result.Status, result.Error.Type, result.Error.Reason)
+		case !options.Verbose && debug && failedItemLog.allow():
+			slog.Debug("failed to index doc", "id", result.ID, "index", result.Index,
+				"status", result.Status, "type", result.Error.Type, "reason", result.Error.Reason)
+		}
+	}
+	if debug {
+		slog.Debug("bulk response", "path", path, "status", response.StatusCode,
+			"items", len(br.Items), "failed", failed, "took", time.Since(started))
+	}
+	return &ItemsError{Failed: failed, Total: len(br.Items)}
+}
+
+// failedItemLog throttles the messages about failed documents of all bulk
+// requests.
+var failedItemLog = &logThrottle{limit: 10}
+
+// logThrottle limits log messages to a number per second, so a flood of
+// failures does not drown everything else. Suppressed messages are counted
+// and reported with the next message, that passes.
+type logThrottle struct {
+	mu         sync.Mutex
+	limit      int // Messages per second.
+	start      time.Time
+	n          int
+	suppressed int
+}
+
+// allow returns true, if a message may be logged now.
+func (l *logThrottle) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now := time.Now(); now.Sub(l.start) >= time.Second {
+		if l.suppressed > 0 {
+			log.Printf("suppressed %d log messages about failed documents", l.suppressed)
+		}
+		l.start, l.n, l.suppressed = now, 0, 0
+	}
+	if l.n < l.limit {
+		l.n++
+		return true
+	}
+	l.suppressed++
+	return false
+}
+
+// addSkipped accounts for documents, that were skipped before sending a bulk
+// request, in the result of the request.
+func addSkipped(err error, skipped, total int) error {
+	if skipped == 0 {
+		return err
+	}
+	switch e := err.(type) {
+	case nil:
+		return &ItemsError{Failed: skipped, Total: total}
+	case *ItemsError:
+		return &ItemsError{Failed: e.Failed + skipped, Total: total}
+	default:
+		return err
+	}
+}
+
+// isRetryable returns true, if a failed request might succeed when retried,
+// which it cannot, once the context is done. Errors may be wrapped.
+func isRetryable(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		switch se.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	// A request, that exceeded the Timeout, while the caller still waits. It
+	// may have been applied, so documents without an id may be duplicated.
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	// Certificate and TLS errors are configuration errors, which do not go
+	// away by retrying, just as errors from signing or unsupported schemes.
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostname         x509.HostnameError
+		invalid          x509.CertificateInvalidError
+		verification     *tls.CertificateVerificationError
+		recordHeader     tls.RecordHeaderError
+	)
+	if errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid) ||
+		errors.As(err, &verification) || errors.As(err, &recordHeader) {
+		return false
+	}
+	// Connection refused, reset, lost or timed out and the like.
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var oe *net.OpError
+	if errors.As(err, &oe) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// defaultRetryMaxWait caps the backoff, if no RetryMaxWait is given.
+const defaultRetryMaxWait = 30 * time.Second
+
+// backoff returns the time to wait before the next attempt, growing
+// exponentially with some jitter, capped at maxWait, or at
+// defaultRetryMaxWait, if maxWait is zero.
+func backoff(attempt int, maxWait time.Duration) time.Duration {
+	if maxWait <= 0 {
+		maxWait = defaultRetryMaxWait
+	}
+	wait := maxWait
+	// Larger shifts overflow, and exceed any sensible cap anyway.
+	if attempt < 32 {
+		if w := 100 * time.Millisecond << uint(attempt); w < maxWait {
+			wait = w
+		}
+	}
+	// Full jitter in [wait/2, wait).
+	half := int64(wait / 2)
+	if half == 0 {
+		return wait
+	}
+	return time.Duration(half + rand.Int63n(half))
+}
+
+// abbreviate shortens a string to at most n bytes for display.
+func abbreviate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// Worker will batch index documents that come in on the lines channel. When
+// the channel is closed, the last, partial batch is indexed, before the worker
+// calls wg.Done. A batch, that could not be indexed, stops the worker and is
+// returned as a *BatchError, so the caller decides whether to exit.
+func Worker(id string, options Options, lines chan string, wg *sync.WaitGroup) error {
+	defer wg.Done()
+	_, err := IndexLines(id, options, lines)
+	return err
+}
+
+// WorkerContext is like Worker, but cancelling the context aborts outstanding
+// bulk requests and the worker returns, without reading further lines. The
+// error then wraps the context error.
+func WorkerContext(ctx context.Context, id string, options Options, lines chan string, wg *sync.WaitGroup) error {
+	defer wg.Done()
+	var stats Stats
+	return indexLines(ctx, id, options, lines, nil, "", nil, &stats)
+}
+
+// IndexLines batch indexes documents that come in on the lines channel, until
+// the channel is closed. Documents rejected by elasticsearch are counted
+// (unless FailFast is set), any other error stops indexing and is returned, a
+// failed batch as a *BatchError. Returns the number of documents that failed.
+func IndexLines(id string, options Options, lines <-chan string) (failed int, err error) {
+	var stats Stats
+	err = indexLines(context.Background(), id, options, lines, nil, "", nil, &stats)
+	return int(stats.Failed), err
+}
+
+// indexLines batch indexes documents from lines or input, until the channel is
+// closed or an error occurs, and adds the outcome to stats atomically. Once
+// the channel is closed, the remaining documents, fewer than a batch, are
+// indexed, before it returns. The positions of documents from input, named by
+// unit in errors, are acked with the tracker, once their batch is indexed. A
+// failed batch stops it with a BatchError. With Adaptive, the batch size grows
+// while requests are fast and shrinks on push-back.
+func indexLines(ctx context.Context, id string, options Options, lines <-chan string, input <-chan document, unit string, t *tracker, stats *Stats) error {
+	var docs []string
+	var positions []int64 // Input positions of docs, if read from input.
+	var size int64        // Bytes in docs.
+	var batch int
+	counter := 0
+	batchSize := options.BatchSize
+	if options.Adaptive {
+		sizer := newBatchSizer(options.BatchSize, options.MinBatchSize, options.MaxBatchSize)
+		batchSize = sizer.size
+		onBulk := options.OnBulk
+		options.OnBulk = func(attempt int, took time.Duration, err error) {
+			if onBulk != nil {
+				onBulk(attempt, took, err)
+			}
+			if sizer.observe(ctx, len(docs), took, err) && options.Verbose {
+				log.Printf("[%s] decreasing batch size to %d", id, sizer.size)
+			}
+			batchSize = sizer.size
+		}
+	}
+	flush := func() error {
+		batch++
+		var where func(i int) string
+		if positions != nil {
+			where = func(i int) string { return fmt.Sprintf("%s %d", unit, positions[i]) }
+		}
+		sent, err := bulkIndex(ctx, docs, where, options)
+		var failed int
+		if ierr, ok := err.(*ItemsError); ok {
+			failed = ierr.Failed
+			if !options.FailFast {
+				err = nil
+			}
+		}
+		atomic.AddInt64(&stats.Failed, int64(failed))
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			berr := &BatchError{
+				Worker:  id,
+				Batch:   batch,
+				Docs:    len(docs),
+				Payload: abbreviate(docs[0], 256),
+				Err:     err,
+			}
+			var serr *StatusError
+			if errors.As(err, &serr) {
+				berr.StatusCode = serr.StatusCode
+			}
+			return berr
+		}
+		t.ack(positions...)
+		atomic.AddInt64(&stats.Indexed, int64(len(docs)-failed))
+		atomic.AddInt64(&stats.Bytes, int64(sent))
+		atomic.AddInt64(&stats.Batches, 1)
 		if options.Verbose {
-			log.Println("Error details: ")
-			for _, v := range br.Items {
-				log.Printf("  %q\n", v.IndexAction.Error)
+			// The fill level shows, which limit flushed the batch, to help
+			// tuning -size and -bytes.
+			fill := fmt.Sprintf("%d/%d docs, %d bytes", len(docs), batchSize, size)
+			if options.BatchBytes > 0 {
+				fill = fmt.Sprintf("%d/%d docs, %d/%d bytes", len(docs), batchSize, size, options.BatchBytes)
 			}
+			log.Printf("[%s] @%d, batch %d: %s\n", id, counter, batch, fill)
 		}
-		return fmt.Errorf("error during bulk operation, check error details, try less workers (lower -w value) or  increase thread_pool.bulk.queue_size in your nodes")
+		docs, positions, size = nil, nil, 0
+		return nil
 	}
-	return nil
-}
-
-// Worker will batch index documents that come in on the lines channel.
-func Worker(id string, options Options, lines chan string, wg *sync.WaitGroup) {
-	defer wg.Done()
-	var docs []string
-	counter := 0
-	for s := range lines {
-		docs = append(docs, s)
-		counter++
-		if counter%options.BatchSize == 0 {
-			msg := make([]string, len(docs))
-			if n := copy(msg, docs); n != len(docs) {
-				log.Fatalf("expected %d, but got %d", len(docs), n)
+	for {
+		var d document
+		var ok bool
+		// Only one of lines and input is set, receiving from the other, nil
+		// channel blocks forever.
+		select {
+		case d.doc, ok = <-lines:
+		case d, ok = <-input:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if !ok {
+			break
+		}
+		if options.MaxRequestBytes > 0 {
+			n := int64(len(d.doc)) + actionOverhead
+			// A document, that does not fit into any request, would fail the
+			// whole batch.
+			if n > options.MaxRequestBytes {
+				log.Printf("[%s] skipping document of %d bytes, larger than the maximum request size of %d bytes: %s",
+					id, len(d.doc), options.MaxRequestBytes, abbreviate(d.doc, 256))
+				atomic.AddInt64(&stats.Failed, 1)
+				if input != nil {
+					t.ack(d.pos)
+				}
+				continue
 			}
-
-			if err := BulkIndex(msg, options); err != nil {
-				log.Fatal(err)
+			// Flush early, if the document would not fit into the request.
+			if len(docs) > 0 && size+int64(len(docs))*actionOverhead+n > options.MaxRequestBytes {
+				if err := flush(); err != nil {
+					return err
+				}
 			}
-			if options.Verbose {
-				log.Printf("[%s] @%d\n", id, counter)
+		}
+		if input != nil {
+			positions = append(positions, d.pos)
+		}
+		docs = append(docs, d.doc)
+		size += int64(len(d.doc))
+		counter++
+		// Flush on whichever limit is reached first.
+		if (batchSize > 0 && len(docs) >= batchSize) ||
+			(options.BatchBytes > 0 && size >= options.BatchBytes) {
+			if err := flush(); err != nil {
+				return err
 			}
-			docs = nil
 		}
 	}
-	if len(docs) == 0 {
-		return
+	// Do not drop the tail of the input.
+	if len(docs) > 0 {
+		return flush()
+	}
+	return nil
+}
+
+// templateAction returns the action line for a document with the metadata,
+// like {"_id": "1", "routing": "a"}, generated by the ActionTemplate. The
+// Index and DocType are used, unless the template sets _index or _type, or
+// CompactActions leaves them to the request path.
+func templateAction(docmap map[string]interface{}, opType string, options Options) (string, error) {
+	var buf bytes.Buffer
+	if err := options.ActionTemplate.Execute(&buf, docmap); err != nil {
+		return "", fmt.Errorf("action template: %v", err)
 	}
-	msg := make([]string, len(docs))
-	if n := copy(msg, docs); n != len(docs) {
-		log.Fatalf("expected %d, but got %d", len(docs), n)
+	var meta map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(buf.Bytes()))
+	dec.UseNumber()
+	if err := dec.Decode(&meta); err != nil || dec.More() || meta == nil {
+		return "", fmt.Errorf("action template must produce a JSON object, got: %s", abbreviate(buf.String(), 256))
 	}
+	if _, ok := meta["_index"]; !ok && options.Index != "" && !options.CompactActions {
+		meta["_index"] = options.Index
+	}
+	if _, ok := meta["_type"]; !ok && options.docType() != "" && !options.CompactActions {
+		meta["_type"] = options.docType()
+	}
+	b, err := json.Marshal(map[string]interface{}{opType: meta})
+	return string(b), err
+}
+
+// actionOverhead estimates the bytes, that the action line and newlines add to
+// each document in a bulk request, for MaxRequestBytes. Actions with long ids
+// or routing values take more, so MaxRequestBytes should stay a little below
+// the limit of the server.
+const actionOverhead = 256
 
-	if err := BulkIndex(msg, options); err != nil {
-		log.Fatal(err)
+// Mapping is a mapping, split into its parts.
+type Mapping struct {
+	Mappings json.RawMessage        // The mappings, like {"properties": ...}.
+	Settings map[string]interface{} // Index settings, only in a create index body.
+	Create   bool                   // The mapping was given as create index body.
+}
+
+// ParseMapping parses a mapping, which is either just the mappings, like
+// {"properties": ...}, as used to update the mapping of an existing index, or
+// a create index body, like {"mappings": ..., "settings": ...}.
+func ParseMapping(b []byte) (Mapping, error) {
+	var m Mapping
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(b, &body); err != nil {
+		return m, fmt.Errorf("invalid mapping: %v", err)
 	}
-	if options.Verbose {
-		log.Printf("[%s] @%d\n", id, counter)
+	mappings, ok := body["mappings"]
+	if !ok {
+		m.Mappings = b
+		return m, nil
 	}
+	for k := range body {
+		if k != "mappings" && k != "settings" {
+			return m, fmt.Errorf("invalid mapping: unsupported key %s next to mappings", k)
+		}
+	}
+	m.Mappings, m.Create = mappings, true
+	if settings, ok := body["settings"]; ok {
+		if err := json.Unmarshal(settings, &m.Settings); err != nil {
+			return m, fmt.Errorf("invalid mapping settings: %v", err)
+		}
+	}
+	return m, nil
 }
 
-// PutMapping applies a mapping from a reader.
+// PutMapping applies a mapping from a reader to an existing index. For a
+// create index body, only its mappings are applied.
 func PutMapping(options Options, body io.Reader) error {
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	m, err := ParseMapping(b)
+	if err != nil {
+		return err
+	}
+	if len(m.Settings) > 0 {
+		log.Printf("index %s exists, ignoring settings of mapping", options.Index)
+	}
 
-	rand.Seed(time.Now().Unix())
-	server := options.Servers[rand.Intn(len(options.Servers))]
-	link := fmt.Sprintf("%s/%s/_mapping/%s", server, options.Index, options.DocType)
-
-	if options.Verbose {
-		log.Printf("applying mapping: %s", link)
+	path := Path(options.Index, "_mapping")
+	if options.docType() != "" {
+		path += Path(options.docType())
 	}
-	req, err := http.NewRequest("PUT", link, body)
+	req, err := options.NewRequest("PUT", path, bytes.NewReader(m.Mappings))
 	if err != nil {
 		return err
 	}
-	if options.Username != "" && options.Password != "" {
-		req.SetBasicAuth(options.Username, options.Password)
+	if options.Verbose {
+		log.Printf("applying mapping: %s", req.URL)
 	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := options.Do(req)
 	if err != nil {
 		return err
 	}
@@ -319,23 +1635,103 @@ func PutMapping(options Options, body io.Reader) error {
 	return resp.Body.Close()
 }
 
-// CreateIndex creates a new index.
-func CreateIndex(options Options) error {
-	rand.Seed(time.Now().Unix())
-	server := options.Servers[rand.Intn(len(options.Servers))]
-	link := fmt.Sprintf("%s/%s", server, options.Index)
-
-	req, err := http.NewRequest("GET", link, nil)
+// PutIndexTemplate creates or updates a composable index template, which
+// applies settings and mappings to matching indices, when they are created.
+func PutIndexTemplate(options Options, name string, body io.Reader) error {
+	req, err := options.NewRequest("PUT", Path("_index_template", name), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if options.Verbose {
+		log.Printf("applying index template: %s", req.URL)
+	}
+	resp, err := options.Do(req)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, resp.Body); err != nil {
+			return err
+		}
+		return fmt.Errorf("failed to apply index template with %s: %s", resp.Status, buf.String())
+	}
+	if options.Verbose {
+		log.Printf("applied index template: %s", resp.Status)
+	}
+	return nil
+}
 
-	if options.Username != "" && options.Password != "" {
-		req.SetBasicAuth(options.Username, options.Password)
+// WaitForCluster polls the cluster health until the cluster reaches at least
+// the given status, green or yellow, or the timeout elapses. Connection errors
+// are retried, since the cluster might still be starting up.
+func WaitForCluster(options Options, status string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	var lastErr error
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("cluster not %s after %s: %v", status, timeout, lastErr)
+		}
+		// Let the server wait, in slices, so a restarting node is noticed,
+		// and within the request timeout.
+		wait := remaining
+		if wait > 10*time.Second {
+			wait = 10 * time.Second
+		}
+		if options.Timeout > 0 && wait > options.Timeout/2 {
+			wait = options.Timeout / 2
+		}
+		path := fmt.Sprintf("%s?wait_for_status=%s&timeout=%dms",
+			Path("_cluster", "health"), status, wait.Milliseconds())
+		req, err := options.NewRequest("GET", path, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := options.Do(req)
+		if err != nil {
+			lastErr = err
+		} else {
+			var health struct {
+				Status   string `json:"status"`
+				TimedOut bool   `json:"timed_out"`
+			}
+			err := json.NewDecoder(resp.Body).Decode(&health)
+			resp.Body.Close()
+			switch {
+			case err != nil:
+				lastErr = err
+			case resp.StatusCode == 200 && !health.TimedOut &&
+				(health.Status == "green" || health.Status == status):
+				if options.Verbose {
+					log.Printf("cluster status is %s", health.Status)
+				}
+				return nil
+			default:
+				lastErr = fmt.Errorf("cluster status is %s (%s)", health.Status, resp.Status)
+			}
+		}
+		if options.Verbose {
+			log.Printf("waiting for cluster: %v", lastErr)
+		}
+		if remaining = time.Until(deadline); remaining > time.Second {
+			remaining = time.Second
+		}
+		if remaining > 0 {
+			time.Sleep(remaining)
+		}
 	}
-	req.Header.Set("Content-Type", "application/json")
+}
 
-	resp, err := http.DefaultClient.Do(req)
+// CreateIndex creates a new index.
+func CreateIndex(options Options) error {
+	req, err := options.NewRequest("GET", Path(options.Index), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := options.Do(req)
 	if err != nil {
 		return err
 	}
@@ -343,19 +1739,36 @@ func CreateIndex(options Options) error {
 
 	// Index already exists, return.
 	if resp.StatusCode == 200 {
+		if options.Verbose && (len(options.IndexSettings) > 0 || len(options.IndexMappings) > 0) {
+			log.Printf("index %s exists, ignoring index settings and mappings", options.Index)
+		}
 		return nil
 	}
 
-	req, err = http.NewRequest("PUT", fmt.Sprintf("%s/%s/", server, options.Index), nil)
-
+	var body io.Reader
+	if len(options.IndexSettings) > 0 || len(options.IndexMappings) > 0 {
+		create := make(map[string]interface{})
+		if len(options.IndexSettings) > 0 {
+			create["settings"] = options.IndexSettings
+		}
+		if len(options.IndexMappings) > 0 {
+			create["mappings"] = options.IndexMappings
+		}
+		b, err := json.Marshal(create)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err = options.NewRequest("PUT", Path(options.Index), body)
 	if err != nil {
 		return err
 	}
-	if options.Username != "" && options.Password != "" {
-		req.SetBasicAuth(options.Username, options.Password)
+	resp, err = options.Do(req)
+	if err != nil {
+		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err = http.DefaultClient.Do(req)
+	defer resp.Body.Close()
 
 	// Elasticsearch backwards compat.
 	if resp.StatusCode == 400 {
@@ -374,6 +1787,40 @@ func CreateIndex(options Options) error {
 		log.Printf("es response was: %s", buf.String())
 	}
 
+	if resp.StatusCode >= 400 {
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, resp.Body); err != nil {
+			return err
+		}
+		return errors.New(buf.String())
+	}
+	if options.Verbose {
+		log.Printf("created index: %s\n", resp.Status)
+	}
+	return nil
+}
+
+// CreateDataStream creates the data stream named by the index, unless it
+// exists. A matching index template with a data_stream section is required.
+func CreateDataStream(options Options) error {
+	path := Path("_data_stream", options.Index)
+	req, err := options.NewRequest("GET", path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := options.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == 200 {
+		return nil
+	}
+	req, err = options.NewRequest("PUT", path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err = options.Do(req)
 	if err != nil {
 		return err
 	}
@@ -383,29 +1830,214 @@ func CreateIndex(options Options) error {
 		if _, err := io.Copy(&buf, resp.Body); err != nil {
 			return err
 		}
-		return errors.New(buf.String())
+		return fmt.Errorf("failed to create data stream %s with %s: %s", options.Index, resp.Status, buf.String())
 	}
 	if options.Verbose {
-		log.Printf("created index: %s\n", resp.Status)
+		log.Printf("created data stream: %s", resp.Status)
 	}
 	return nil
 }
 
-// DeleteIndex removes an index.
-func DeleteIndex(options Options) error {
-	rand.Seed(time.Now().Unix())
-	server := options.Servers[rand.Intn(len(options.Servers))]
-	link := fmt.Sprintf("%s/%s", server, options.Index)
+// IndexExists returns true, if the index exists.
+func IndexExists(options Options) (bool, error) {
+	req, err := options.NewRequest("HEAD", Path(options.Index), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := options.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 200:
+		return true, nil
+	case 404:
+		return false, nil
+	default:
+		return false, fmt.Errorf("cannot check index %s: %s", options.Index, resp.Status)
+	}
+}
+
+// CountDocuments returns the number of documents in the index.
+func CountDocuments(options Options) (int64, error) {
+	req, err := options.NewRequest("GET", Path(options.Index, "_count"), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := options.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return 0, fmt.Errorf("cannot count documents in %s: %s", options.Index, resp.Status)
+	}
+	var count struct {
+		Count int64 `json:"count"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&count); err != nil {
+		return 0, err
+	}
+	return count.Count, nil
+}
+
+// AliasIndices returns the indices an alias points to, none if the alias
+// does not exist.
+func AliasIndices(options Options, alias string) ([]string, error) {
+	req, err := options.NewRequest("GET", Path("_alias", alias), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := options.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 404 {
+		return nil, nil
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("cannot get alias %s: %s", alias, resp.Status)
+	}
+	// The response maps index names to their aliases.
+	var doc map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	var indices []string
+	for index := range doc {
+		indices = append(indices, index)
+	}
+	sort.Strings(indices)
+	return indices, nil
+}
+
+// UpdateAlias adds an alias to the index. With swap, the alias is removed
+// from all other indices in the same request, so the switch is atomic.
+func UpdateAlias(options Options, alias string, swap bool) error {
+	type action map[string]map[string]string
+	var actions []action
+	if swap {
+		indices, err := AliasIndices(options, alias)
+		if err != nil {
+			return err
+		}
+		for _, index := range indices {
+			if index != options.Index {
+				actions = append(actions, action{"remove": {"index": index, "alias": alias}})
+			}
+		}
+	}
+	actions = append(actions, action{"add": {"index": options.Index, "alias": alias}})
+	b, err := json.Marshal(map[string]interface{}{"actions": actions})
+	if err != nil {
+		return err
+	}
+	req, err := options.NewRequest("POST", Path("_aliases"), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := options.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, resp.Body); err != nil {
+			return err
+		}
+		return fmt.Errorf("failed to update alias with %s: %s", resp.Status, buf.String())
+	}
+	if options.Verbose {
+		log.Printf("updated alias %s: %s", alias, b)
+	}
+	return nil
+}
 
-	req, err := http.NewRequest("DELETE", link, nil)
+// ForceMerge merges the segments of the index down to at most maxSegments and
+// waits for it to complete, which can take long for large indices. The
+// timeout replaces Options.Timeout for this request, zero means no timeout.
+func ForceMerge(options Options, maxSegments int, timeout time.Duration) error {
+	path := fmt.Sprintf("%s?max_num_segments=%d", Path(options.Index, "_forcemerge"), maxSegments)
+	req, err := options.NewRequest("POST", path, nil)
+	if err != nil {
+		return err
+	}
+	options.Timeout = timeout
+	if options.Verbose {
+		log.Printf("force merging index %s to %d segments, this may take a while", options.Index, maxSegments)
+	}
+	start := time.Now()
+	resp, err := options.Do(req)
 	if err != nil {
 		return err
 	}
-	if options.Username != "" && options.Password != "" {
-		req.SetBasicAuth(options.Username, options.Password)
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, resp.Body); err != nil {
+			return err
+		}
+		return fmt.Errorf("failed to force merge with %s: %s", resp.Status, buf.String())
+	}
+	if options.Verbose {
+		log.Printf("force merged index %s to %d segments in %s", options.Index, maxSegments, time.Since(start))
+	}
+	return nil
+}
+
+// Rollover asks elasticsearch to roll the alias or data stream Index over to
+// a new index, if the current write index has at least maxDocs documents.
+// It returns the name of the new index, or an empty string, if the condition
+// is not met yet. Documents sent to the alias always go to its current write
+// index, so concurrent bulk requests need no coordination.
+func Rollover(options Options, maxDocs int64) (string, error) {
+	b, err := json.Marshal(map[string]interface{}{
+		"conditions": map[string]int64{"max_docs": maxDocs},
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := options.NewRequest("POST", Path(options.Index, "_rollover"), bytes.NewReader(b))
+	if err != nil {
+		return "", err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := options.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, resp.Body); err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("failed to roll over %s with %s: %s", options.Index, resp.Status, buf.String())
+	}
+	var result struct {
+		NewIndex   string `json:"new_index"`
+		RolledOver bool   `json:"rolled_over"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if !result.RolledOver {
+		return "", nil
+	}
+	return result.NewIndex, nil
+}
+
+// DeleteIndex removes an index.
+func DeleteIndex(options Options) error {
+	req, err := options.NewRequest("DELETE", Path(options.Index), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := options.Do(req)
 	if err != nil {
 		return err
 	}
@@ -414,3 +2046,51 @@ func DeleteIndex(options Options) error {
 	}
 	return resp.Body.Close()
 }
+
+// ServerVersion returns the version number reported by the server, like
+// "7.10.2", and its distribution, either "elasticsearch" or "opensearch".
+func ServerVersion(options Options) (number, distribution string, err error) {
+	req, err := options.NewRequest("GET", Path(), nil)
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := options.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, resp.Body); err != nil {
+			return "", "", err
+		}
+		return "", "", fmt.Errorf("version probe failed with %s: %s", resp.Status, buf.String())
+	}
+	var info struct {
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", "", err
+	}
+	if info.Version.Number == "" {
+		return "", "", errors.New("server did not report a version number")
+	}
+	distribution = info.Version.Distribution
+	if distribution == "" {
+		distribution = "elasticsearch"
+	}
+	return info.Version.Number, distribution, nil
+}
+
+// MajorVersion returns the major version of a version string like "7.10.2".
+func MajorVersion(version string) (int, error) {
+	major := strings.SplitN(version, ".", 2)[0]
+	v, err := strconv.Atoi(major)
+	if err != nil {
+		return 0, fmt.Errorf("invalid version: %s", version)
+	}
+	return v, nil
+}
@@ -0,0 +1,648 @@
+package esbulk
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestBulkRequest(t *testing.T) {
+	var cases = []struct {
+		about   string
+		docs    []string
+		options Options
+		path    string
+		body    string
+		skipped int
+	}{
+		{
+			about:   "plain index",
+			docs:    []string{`{"a": 1}`},
+			options: Options{Index: "x"},
+			path:    "/_bulk",
+			body:    "{\"index\":{\"_index\":\"x\"}}\n{\"a\": 1}\n",
+		},
+		{
+			about:   "doc type",
+			docs:    []string{`{"a": 1}`},
+			options: Options{Index: "x", DocType: "default"},
+			path:    "/_bulk",
+			body:    "{\"index\":{\"_index\":\"x\",\"_type\":\"default\"}}\n{\"a\": 1}\n",
+		},
+		{
+			about:   "id field",
+			docs:    []string{`{"id": "1", "a": 1}`, `{"id": 2}`},
+			options: Options{Index: "x", IDField: "id"},
+			path:    "/_bulk",
+			body: "{\"index\":{\"_index\":\"x\",\"_id\":\"1\"}}\n{\"id\": \"1\", \"a\": 1}\n" +
+				"{\"index\":{\"_index\":\"x\",\"_id\":\"2\"}}\n{\"id\": 2}\n",
+		},
+		{
+			about:   "skip missing id",
+			docs:    []string{`{"id": "1"}`, `{"a": 1}`, `{"b": 2}`},
+			options: Options{Index: "x", IDField: "id", SkipMissingID: true},
+			path:    "/_bulk",
+			body:    "{\"index\":{\"_index\":\"x\",\"_id\":\"1\"}}\n{\"id\": \"1\"}\n",
+			skipped: 2,
+		},
+		{
+			about:   "all skipped",
+			docs:    []string{`{"a": 1}`},
+			options: Options{Index: "x", IDField: "id", SkipMissingID: true},
+			path:    "/_bulk",
+			body:    "",
+			skipped: 1,
+		},
+		{
+			about:   "compact actions",
+			docs:    []string{`{"a": 1}`},
+			options: Options{Index: "x", CompactActions: true},
+			path:    "/x/_bulk",
+			body:    "{\"index\":{}}\n{\"a\": 1}\n",
+		},
+		{
+			about:   "delete with plain ids",
+			docs:    []string{"1", "2"},
+			options: Options{Index: "x", OpType: "delete"},
+			path:    "/_bulk",
+			body:    "{\"delete\":{\"_index\":\"x\",\"_id\":\"1\"}}\n{\"delete\":{\"_index\":\"x\",\"_id\":\"2\"}}\n",
+		},
+		{
+			about:   "pipeline and refresh",
+			docs:    []string{`{"a": 1}`},
+			options: Options{Index: "x", Pipeline: "p", BulkRefresh: "wait_for"},
+			path:    "/_bulk?pipeline=p&refresh=wait_for",
+			body:    "{\"index\":{\"_index\":\"x\"}}\n{\"a\": 1}\n",
+		},
+		{
+			about:   "blank documents",
+			docs:    []string{"", "  "},
+			options: Options{Index: "x"},
+			path:    "/_bulk",
+			body:    "",
+		},
+	}
+	for _, c := range cases {
+		path, body, skipped, err := BulkRequest(c.docs, c.options)
+		if err != nil {
+			t.Errorf("%s: got %v, want nil", c.about, err)
+			continue
+		}
+		if path != c.path {
+			t.Errorf("%s: got path %q, want %q", c.about, path, c.path)
+		}
+		if string(body) != c.body {
+			t.Errorf("%s: got body %q, want %q", c.about, body, c.body)
+		}
+		if skipped != c.skipped {
+			t.Errorf("%s: got %d skipped, want %d", c.about, skipped, c.skipped)
+		}
+	}
+}
+
+func TestBulkRequestMissingID(t *testing.T) {
+	_, _, _, err := BulkRequest([]string{`{"a": 1}`}, Options{Index: "x", IDField: "id"})
+	if err == nil {
+		t.Fatalf("got nil, want an error for a missing id")
+	}
+}
+
+// bulkServer records the bodies of bulk requests and responds, as if all
+// documents were indexed.
+type bulkServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	bodies []string
+}
+
+func newBulkServer(t testing.TB) *bulkServer {
+	s := &bulkServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/_bulk") {
+			http.NotFound(w, r)
+			return
+		}
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("reading body: %v", err)
+		}
+		s.mu.Lock()
+		s.bodies = append(s.bodies, string(b))
+		s.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"took":1,"errors":false,"items":[]}`)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// requests returns the bodies received so far.
+func (s *bulkServer) requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.bodies...)
+}
+
+func TestRunBatches(t *testing.T) {
+	srv := newBulkServer(t)
+	input := `{"id": "1"}
+{"id": "2"}
+{"id": "3"}
+{"id": "4"}
+{"id": "5"}
+`
+	options := Options{
+		Servers:   []string{srv.URL},
+		Index:     "x",
+		DocType:   "default",
+		IDField:   "id",
+		BatchSize: 2,
+		Workers:   1,
+	}
+	stats, err := Run(context.Background(), options, strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	if stats.Docs != 5 {
+		t.Errorf("got %d docs, want 5", stats.Docs)
+	}
+	want := []string{
+		"{\"index\":{\"_index\":\"x\",\"_type\":\"default\",\"_id\":\"1\"}}\n{\"id\": \"1\"}\n" +
+			"{\"index\":{\"_index\":\"x\",\"_type\":\"default\",\"_id\":\"2\"}}\n{\"id\": \"2\"}\n",
+		"{\"index\":{\"_index\":\"x\",\"_type\":\"default\",\"_id\":\"3\"}}\n{\"id\": \"3\"}\n" +
+			"{\"index\":{\"_index\":\"x\",\"_type\":\"default\",\"_id\":\"4\"}}\n{\"id\": \"4\"}\n",
+		"{\"index\":{\"_index\":\"x\",\"_type\":\"default\",\"_id\":\"5\"}}\n{\"id\": \"5\"}\n",
+	}
+	if got := srv.requests(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRunPartialBatches(t *testing.T) {
+	// Fewer documents than BatchSize * Workers, so each worker ends with a
+	// partial batch, if any.
+	srv := newBulkServer(t)
+	var input strings.Builder
+	for i := 0; i < 7; i++ {
+		fmt.Fprintf(&input, "{\"id\": \"%d\"}\n", i)
+	}
+	options := Options{
+		Servers:   []string{srv.URL},
+		Index:     "x",
+		IDField:   "id",
+		BatchSize: 5,
+		Workers:   4,
+	}
+	stats, err := Run(context.Background(), options, strings.NewReader(input.String()))
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	if stats.Docs != 7 || stats.Indexed != 7 {
+		t.Errorf("got %d docs, %d indexed, want 7, 7", stats.Docs, stats.Indexed)
+	}
+	body := strings.Join(srv.requests(), "")
+	for i := 0; i < 7; i++ {
+		if id := fmt.Sprintf(`"_id":"%d"`, i); strings.Count(body, id) != 1 {
+			t.Errorf("document %d sent %d times, want once", i, strings.Count(body, id))
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	done, cancel := context.WithCancel(context.Background())
+	cancel()
+	urlErr := &url.Error{Op: "Post", URL: "http://localhost:9200/_bulk", Err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}
+	wrap := func(err error) error {
+		return &url.Error{Op: "Post", URL: "https://localhost:9200/_bulk", Err: err}
+	}
+	var cases = []struct {
+		about string
+		ctx   context.Context
+		err   error
+		want  bool
+	}{
+		{"nil", context.Background(), nil, false},
+		{"too many requests", context.Background(), &StatusError{StatusCode: 429}, true},
+		{"unavailable", context.Background(), &StatusError{StatusCode: 503}, true},
+		{"bad request", context.Background(), &StatusError{StatusCode: 400}, false},
+		{"wrapped status", context.Background(), fmt.Errorf("bulk: %w", &StatusError{StatusCode: 502}), true},
+		{"connection error", context.Background(), urlErr, true},
+		{"wrapped connection error", context.Background(), fmt.Errorf("bulk: %w", urlErr), true},
+		{"timeout", context.Background(), fmt.Errorf("reading response: %w", context.DeadlineExceeded), true},
+		{"timeout, caller done", done, context.DeadlineExceeded, false},
+		{"connection error, caller done", done, urlErr, false},
+		{"connection reset", context.Background(), wrap(syscall.ECONNRESET), true},
+		{"connection lost", context.Background(), wrap(io.EOF), true},
+		{"unknown authority", context.Background(), wrap(&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}), false},
+		{"hostname mismatch", context.Background(), wrap(x509.HostnameError{Host: "localhost"}), false},
+		{"not tls", context.Background(), wrap(tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}), false},
+		{"unsupported scheme", context.Background(), wrap(errors.New(`unsupported protocol scheme "ftp"`)), false},
+		{"signing failed", context.Background(), wrap(errors.New("cannot resolve aws credentials")), false},
+		{"items", context.Background(), &ItemsError{Failed: 1, Total: 2}, false},
+		{"other", context.Background(), errors.New("invalid character"), false},
+	}
+	for _, c := range cases {
+		if got := isRetryable(c.ctx, c.err); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.about, got, c.want)
+		}
+	}
+}
+
+func TestSetServer(t *testing.T) {
+	var cases = []struct {
+		server string
+		scheme string
+		host   string
+		port   int
+		err    bool
+	}{
+		{server: "http://localhost:9200", scheme: "http", host: "localhost", port: 9200},
+		{server: "http://[::1]:9200", scheme: "http", host: "::1", port: 9200},
+		{server: "https://host", scheme: "https", host: "host", port: 443},
+		{server: "http://host", scheme: "http", host: "host", port: 80},
+		{server: "http://proxy/es/", scheme: "http", host: "proxy", port: 80},
+		{server: "localhost:9200", err: true},
+		{server: "http://", err: true},
+		{server: "http://host:port", err: true},
+		{server: "http://[::1", err: true},
+	}
+	for _, c := range cases {
+		var options Options
+		err := options.SetServer(c.server)
+		if (err != nil) != c.err {
+			t.Errorf("%s: got %v, want error %v", c.server, err, c.err)
+			continue
+		}
+		if c.err {
+			continue
+		}
+		if options.Scheme != c.scheme || options.Host != c.host || options.Port != c.port {
+			t.Errorf("%s: got %s %s %d, want %s %s %d", c.server,
+				options.Scheme, options.Host, options.Port, c.scheme, c.host, c.port)
+		}
+	}
+}
+
+func TestOptionsString(t *testing.T) {
+	options := Options{
+		Servers:  []string{"http://localhost:9200", "https://admin:s3cret@es:9200"},
+		Index:    "example",
+		Username: "elastic",
+		Password: "changeme",
+		APIKey:   "c2VjcmV0a2V5",
+		Headers:  http.Header{"X-Tenant-Token": []string{"t0ken", "t1ken"}},
+	}
+	s := options.String()
+	for _, secret := range []string{"changeme", "c2VjcmV0a2V5", "s3cret", "t0ken", "t1ken"} {
+		if strings.Contains(s, secret) {
+			t.Errorf("%s contains %s", s, secret)
+		}
+	}
+	for _, kept := range []string{"example", "elastic", "http://localhost:9200", "https://admin:xxxxx@es:9200", "X-Tenant-Token"} {
+		if !strings.Contains(s, kept) {
+			t.Errorf("%s does not contain %s", s, kept)
+		}
+	}
+	if options.Password != "changeme" || options.Headers.Get("X-Tenant-Token") != "t0ken" || options.Servers[1] != "https://admin:s3cret@es:9200" {
+		t.Errorf("String changed the options")
+	}
+	if got := fmt.Sprint(options); got != s {
+		t.Errorf("fmt.Sprint: got %s, want %s", got, s)
+	}
+}
+
+func TestDocumentIDTemplate(t *testing.T) {
+	var cases = []struct {
+		about    string
+		template string
+		input    string
+		skip     bool
+		err      string
+		requests []string
+	}{
+		{
+			about:    "id from template",
+			template: `{{.a}}-{{.b}}`,
+			input:    "{\"a\": 1, \"b\": \"x\"}\n",
+			requests: []string{"{\"index\":{\"_index\":\"x\",\"_id\":\"1-x\"}}\n{\"a\": 1, \"b\": \"x\"}\n"},
+		},
+		{
+			about:    "nested fields",
+			template: `{{.tenant.name}}-{{index .sku 0}}`,
+			input:    "{\"tenant\": {\"name\": \"acme\"}, \"sku\": [1234, 5678]}\n",
+			requests: []string{"{\"index\":{\"_index\":\"x\",\"_id\":\"acme-1234\"}}\n{\"tenant\": {\"name\": \"acme\"}, \"sku\": [1234, 5678]}\n"},
+		},
+		{
+			about:    "missing nested field with line number",
+			template: `{{.tenant.name}}`,
+			input:    "{\"tenant\": {\"name\": \"acme\"}}\n{\"tenant\": {}}\n",
+			err:      "line 2: cannot execute id template",
+		},
+		{
+			about:    "template error with line number",
+			template: `{{.a}}`,
+			input:    "{\"a\": 1}\n\n{\"b\": 2}\n",
+			err:      "line 3: cannot execute id template",
+		},
+		{
+			about:    "empty id with line number",
+			template: `{{.a}}`,
+			input:    "{\"a\": 1}\n{\"a\": \"\"}\n",
+			err:      "line 2: id template returned an empty id",
+		},
+		{
+			about:    "empty id skipped",
+			template: `{{.a}}`,
+			input:    "{\"a\": 1}\n{\"a\": \"\"}\n",
+			skip:     true,
+			requests: []string{"{\"index\":{\"_index\":\"x\",\"_id\":\"1\"}}\n{\"a\": 1}\n"},
+		},
+	}
+	for _, c := range cases {
+		srv := newBulkServer(t)
+		options := Options{
+			Servers:       []string{srv.URL},
+			Index:         "x",
+			BatchSize:     10,
+			IDTemplate:    template.Must(template.New("id").Option("missingkey=error").Parse(c.template)),
+			SkipMissingID: c.skip,
+		}
+		_, err := Run(context.Background(), options, strings.NewReader(c.input))
+		switch {
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Errorf("%s: got %v, want %s", c.about, err, c.err)
+		case c.err == "" && err != nil:
+			t.Errorf("%s: got %v, want nil", c.about, err)
+		}
+		if got := srv.requests(); c.err == "" && !reflect.DeepEqual(got, c.requests) {
+			t.Errorf("%s: got %q, want %q", c.about, got, c.requests)
+		}
+	}
+}
+
+func TestWorkerContextBatchError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"bad request"}`, http.StatusBadRequest)
+	}))
+	defer srv.Close()
+	options := Options{Servers: []string{srv.URL}, Index: "x", BatchSize: 10}
+	lines := make(chan string, 1)
+	lines <- `{"a": 1}`
+	close(lines)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	err := WorkerContext(context.Background(), "worker-0", options, lines, &wg)
+	wg.Wait()
+	var berr *BatchError
+	if !errors.As(err, &berr) {
+		t.Fatalf("got %v, want a *BatchError", err)
+	}
+	if berr.Worker != "worker-0" || berr.Batch != 1 || berr.StatusCode != http.StatusBadRequest {
+		t.Errorf("got worker %s, batch %d, status %d, want worker-0, batch 1, status 400",
+			berr.Worker, berr.Batch, berr.StatusCode)
+	}
+}
+
+func TestActionTemplateLineNumber(t *testing.T) {
+	var cases = []struct {
+		about    string
+		template string
+		opType   string
+		err      string
+	}{
+		{"invalid JSON", `{{if .id}}{"_id": "{{.id}}"}{{else}}-{{end}}`, "", "line 2: action template must produce a JSON object"},
+		{"invalid JSON on delete", `{{if .id}}{"_id": "{{.id}}"}{{else}}-{{end}}`, "delete", "line 2: action template must produce a JSON object"},
+		{"missing field", `{"_id": "{{index .id "x"}}"}`, "", "line 2: action template: "},
+	}
+	for _, c := range cases {
+		srv := newBulkServer(t)
+		options := Options{
+			Servers:        []string{srv.URL},
+			Index:          "x",
+			BatchSize:      10,
+			OpType:         c.opType,
+			ActionTemplate: template.Must(template.New("action").Parse(c.template)),
+		}
+		input := "{\"id\": {\"x\": 1}}\n{\"name\": \"a\"}\n"
+		if _, err := Run(context.Background(), options, strings.NewReader(input)); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: got %v, want %s", c.about, err, c.err)
+		}
+	}
+}
+
+func TestVersionFieldErrors(t *testing.T) {
+	long := strings.Repeat("x", 1000)
+	var cases = []struct {
+		about string
+		input string
+		err   string
+	}{
+		{"missing version", `{"v": 1}` + "\n" + `{"a": "` + long + `"}` + "\n", "line 2: document has no version field (v)"},
+		{"invalid version", `{"v": 1}` + "\n" + `{"v": "x", "a": "` + long + `"}` + "\n", "line 2: invalid version (v)"},
+	}
+	for _, c := range cases {
+		srv := newBulkServer(t)
+		options := Options{
+			Servers:         []string{srv.URL},
+			Index:           "x",
+			BatchSize:       10,
+			VersionField:    "v",
+			VersionRequired: true,
+		}
+		_, err := Run(context.Background(), options, strings.NewReader(c.input))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: got %v, want %s", c.about, err, c.err)
+			continue
+		}
+		if strings.Contains(err.Error(), long) {
+			t.Errorf("%s: got the whole document in %v", c.about, err)
+		}
+	}
+}
+
+func TestPath(t *testing.T) {
+	var cases = []struct {
+		segments []string
+		want     string
+	}{
+		{nil, "/"},
+		{[]string{"x", "_bulk"}, "/x/_bulk"},
+		{[]string{"<logs-{now/d}>", "_settings"}, "/%3Clogs-%7Bnow%2Fd%7D%3E/_settings"},
+		{[]string{"a+b", "_doc", "1 2"}, "/a%2Bb/_doc/1%202"},
+	}
+	for _, c := range cases {
+		if got := Path(c.segments...); got != c.want {
+			t.Errorf("%q: got %s, want %s", c.segments, got, c.want)
+		}
+	}
+}
+
+func TestPathDateMathRoundTrip(t *testing.T) {
+	const index = "<logs-{now/d}>"
+	var segments []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, s := range strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/") {
+			u, err := url.PathUnescape(s)
+			if err != nil {
+				t.Errorf("unescape %s: %v", s, err)
+			}
+			segments = append(segments, u)
+		}
+	}))
+	defer srv.Close()
+	options := Options{Servers: []string{srv.URL}}
+	req, err := options.NewRequest("GET", Path(index, "_settings"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := options.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if want := []string{index, "_settings"}; !reflect.DeepEqual(segments, want) {
+		t.Errorf("got %q, want %q", segments, want)
+	}
+}
+
+func TestJoinParentField(t *testing.T) {
+	srv := newBulkServer(t)
+	input := `{"id": "q1", "text": "question", "qa": {"name": "question"}}
+{"id": "a1", "text": "answer", "qa": {"name": "answer", "parent": "q1"}}
+{"id": "a2", "text": "answer", "qa": {"name": "answer", "parent": 2}}
+`
+	options := Options{
+		Servers:         []string{srv.URL},
+		Index:           "qa",
+		IDField:         "id",
+		JoinParentField: "qa.parent",
+		BatchSize:       10,
+	}
+	if _, err := Run(context.Background(), options, strings.NewReader(input)); err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	lines := strings.Split(input, "\n")
+	want := []string{
+		"{\"index\":{\"_index\":\"qa\",\"_id\":\"q1\"}}\n" + lines[0] + "\n" +
+			"{\"index\":{\"_index\":\"qa\",\"_id\":\"a1\",\"routing\":\"q1\"}}\n" + lines[1] + "\n" +
+			"{\"index\":{\"_index\":\"qa\",\"_id\":\"a2\",\"routing\":\"2\"}}\n" + lines[2] + "\n",
+	}
+	if got := srv.requests(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// benchDocs returns n documents of a few hundred bytes, with some repetition,
+// like typical log or catalog records.
+func benchDocs(n int) []string {
+	docs := make([]string, n)
+	for i := range docs {
+		docs[i] = fmt.Sprintf(`{"id": "%d", "title": "Document number %d", "tags": ["alpha", "beta", "gamma"], `+
+			`"author": {"name": "Author %d", "email": "author%d@example.com"}, "body": "%s"}`,
+			i, i, i%100, i%100, strings.Repeat("lorem ipsum dolor sit amet ", 8))
+	}
+	return docs
+}
+
+// BenchmarkBulkIndexGzip compares the time to send a batch with and without
+// RequestGzip, which trades CPU for fewer bytes on the wire.
+func BenchmarkBulkIndexGzip(b *testing.B) {
+	docs := benchDocs(1000)
+	srv := newBulkServer(b)
+	for _, gz := range []bool{false, true} {
+		b.Run(fmt.Sprintf("gzip=%v", gz), func(b *testing.B) {
+			options := Options{Servers: []string{srv.URL}, Index: "x", RequestGzip: gz}
+			_, body, _, err := BulkRequest(docs, options)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(len(body)))
+			var sent int
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if sent, err = bulkIndex(context.Background(), docs, nil, options); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(sent), "sent-bytes/op")
+		})
+	}
+}
+
+// BenchmarkRunBatchSize indexes the same documents with growing batch sizes,
+// fewer and larger bulk requests raise the throughput.
+func BenchmarkRunBatchSize(b *testing.B) {
+	input := strings.Join(benchDocs(2000), "\n") + "\n"
+	srv := newBulkServer(b)
+	for _, size := range []int{1, 10, 100, 1000} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			options := Options{Servers: []string{srv.URL}, Index: "x", BatchSize: size, Workers: 1}
+			b.SetBytes(int64(len(input)))
+			var docs int64
+			for i := 0; i < b.N; i++ {
+				stats, err := Run(context.Background(), options, strings.NewReader(input))
+				if err != nil {
+					b.Fatal(err)
+				}
+				docs += stats.Indexed
+			}
+			b.ReportMetric(float64(docs)/b.Elapsed().Seconds(), "docs/s")
+		})
+	}
+}
+
+// BenchmarkCompactActions builds bulk requests with full and with compact
+// action lines and reports the size of the body per document.
+func BenchmarkCompactActions(b *testing.B) {
+	docs := benchDocs(1000)
+	for _, compact := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compact=%v", compact), func(b *testing.B) {
+			options := Options{Index: "logs-2024.01.02", DocType: "default", CompactActions: compact}
+			var body []byte
+			var err error
+			for i := 0; i < b.N; i++ {
+				if _, body, _, err = BulkRequest(docs, options); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(body))/float64(len(docs)), "body-bytes/doc")
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	var cases = []struct {
+		about   string
+		attempt int
+		maxWait time.Duration
+		min     time.Duration
+		max     time.Duration
+	}{
+		{about: "first attempt", attempt: 0, maxWait: time.Minute, min: 50 * time.Millisecond, max: 100 * time.Millisecond},
+		{about: "capped", attempt: 10, maxWait: time.Second, min: 500 * time.Millisecond, max: time.Second},
+		{about: "no cap uses the default", attempt: 20, min: defaultRetryMaxWait / 2, max: defaultRetryMaxWait},
+		{about: "shift overflows", attempt: 37, maxWait: time.Second, min: 500 * time.Millisecond, max: time.Second},
+		{about: "shift overflows without cap", attempt: 100, min: defaultRetryMaxWait / 2, max: defaultRetryMaxWait},
+	}
+	for _, c := range cases {
+		for i := 0; i < 10; i++ {
+			if got := backoff(c.attempt, c.maxWait); got < c.min || got >= c.max {
+				t.Errorf("%s: got %s, want in [%s, %s)", c.about, got, c.min, c.max)
+			}
+		}
+	}
+}
@@ -0,0 +1,169 @@
+//go:build integration
+// +build integration
+
+package esbulk
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/elasticsearch"
+)
+
+// TestIntegration runs esbulk against elasticsearch in a docker container and
+// checks document counts, ids, mappings and purge. It needs docker and runs
+// only with ESBULK_INTEGRATION=1, ES_IMAGE selects another image:
+//
+//	$ ESBULK_INTEGRATION=1 go test -tags integration -run Integration .
+func TestIntegration(t *testing.T) {
+	if os.Getenv("ESBULK_INTEGRATION") != "1" {
+		t.Skip("skipping integration tests, set ESBULK_INTEGRATION=1 to run them")
+	}
+	image := os.Getenv("ES_IMAGE")
+	if image == "" {
+		image = "docker.elastic.co/elasticsearch/elasticsearch:8.15.0"
+	}
+	ctx := context.Background()
+	es, err := elasticsearch.Run(ctx, image)
+	testcontainers.CleanupContainer(t, es)
+	if err != nil {
+		t.Fatalf("cannot start elasticsearch: %v", err)
+	}
+
+	client := http.DefaultClient
+	if es.Settings.CACert != nil {
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(es.Settings.CACert)
+		client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	}
+	base := Options{
+		Servers:     []string{es.Settings.Address},
+		Username:    es.Settings.Username,
+		Password:    es.Settings.Password,
+		HTTPClient:  client,
+		Typeless:    true,
+		BatchSize:   2,
+		BulkRefresh: "wait_for",
+	}
+	docs := `{"id": "a", "name": "alpha", "n": 1}
+{"id": "b", "name": "beta", "n": 2}
+{"id": "c", "name": "gamma", "n": 3}
+`
+	mapping := `{"properties": {"name": {"type": "keyword"}, "n": {"type": "integer"}}}`
+
+	// load runs a load and fails the test on an error.
+	load := func(options Options, input string) Stats {
+		t.Helper()
+		stats, err := Run(ctx, options, strings.NewReader(input))
+		if err != nil {
+			t.Fatalf("load into %s: %v", options.Index, err)
+		}
+		return stats
+	}
+	// expectCount compares the number of documents in an index.
+	expectCount := func(about string, options Options, want int64) {
+		t.Helper()
+		n, err := CountDocuments(options)
+		if err != nil {
+			t.Fatalf("%s: %v", about, err)
+		}
+		if n != want {
+			t.Errorf("%s: got %d documents, want %d", about, n, want)
+		}
+	}
+	// get decodes the response to a GET request.
+	get := func(options Options, path string, v interface{}) {
+		t.Helper()
+		req, err := options.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := options.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("GET %s: %s", path, resp.Status)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Ids from a field, with a mapping, which is applied to the new index.
+	ids := base
+	ids.Index = "esbulk-it-ids"
+	ids.IDField = "id"
+	if err := CreateIndex(ids); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutMapping(ids, strings.NewReader(mapping)); err != nil {
+		t.Fatal(err)
+	}
+	load(ids, docs)
+	expectCount("count with ids", ids, 3)
+	var doc struct {
+		Source struct {
+			Name string `json:"name"`
+		} `json:"_source"`
+	}
+	get(ids, Path(ids.Index, "_doc", "b"), &doc)
+	if doc.Source.Name != "beta" {
+		t.Errorf("document by id: got %q, want beta", doc.Source.Name)
+	}
+	var m map[string]struct {
+		Mappings struct {
+			Properties map[string]struct {
+				Type string `json:"type"`
+			} `json:"properties"`
+		} `json:"mappings"`
+	}
+	get(ids, Path(ids.Index, "_mapping"), &m)
+	if typ := m[ids.Index].Mappings.Properties["name"].Type; typ != "keyword" {
+		t.Errorf("mapping: got %q, want keyword", typ)
+	}
+
+	// Loading again with the same ids replaces the documents.
+	load(ids, docs)
+	expectCount("count after reload with ids", ids, 3)
+
+	// A document rejected by the mapping is counted as failed.
+	stats := load(ids, docs+`{"id": "d", "name": "delta", "n": "not a number"}`+"\n")
+	if stats.Failed != 1 {
+		t.Errorf("failed documents: got %d, want 1", stats.Failed)
+	}
+	expectCount("count with a failed document", ids, 3)
+
+	// Autogenerated ids add documents on each load, until the index is
+	// deleted.
+	auto := base
+	auto.Index = "esbulk-it-auto"
+	if err := CreateIndex(auto); err != nil {
+		t.Fatal(err)
+	}
+	load(auto, docs)
+	load(auto, docs)
+	expectCount("count with autogenerated ids", auto, 6)
+	if err := DeleteIndex(auto); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateIndex(auto); err != nil {
+		t.Fatal(err)
+	}
+	load(auto, docs)
+	expectCount("count after purge", auto, 3)
+
+	for _, options := range []Options{ids, auto} {
+		if err := DeleteIndex(options); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package esbulk
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/time/rate"
+)
+
+// waitN blocks, until the limiter, if not nil, lets n events, like documents
+// or bytes, pass, or the context is done. A request larger than the burst of
+// the limiter, like a bulk request with more than a second worth of bytes, is
+// let through in parts, which delays the following ones accordingly. A
+// limiter with an infinite limit lets everything pass, a limiter without a
+// burst nothing, which is an error.
+func waitN(ctx context.Context, l *rate.Limiter, n int) error {
+	if l == nil || l.Limit() == rate.Inf {
+		return nil
+	}
+	b := l.Burst()
+	if b <= 0 {
+		return fmt.Errorf("rate limiter burst must be positive, got %d", b)
+	}
+	for n > 0 {
+		k := n
+		if k > b {
+			k = b
+		}
+		if err := l.WaitN(ctx, k); err != nil {
+			return err
+		}
+		n -= k
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package esbulk
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestWaitN(t *testing.T) {
+	var cases = []struct {
+		about   string
+		limiter *rate.Limiter
+		n       int
+		min     time.Duration
+		err     bool
+	}{
+		{about: "no limiter", n: 1000},
+		{about: "within burst", limiter: rate.NewLimiter(1000, 1000), n: 1000},
+		// The first 100 pass at once, the other 200 take 200ms.
+		{about: "split into bursts", limiter: rate.NewLimiter(1000, 100), n: 300, min: 150 * time.Millisecond},
+		{about: "infinite limit", limiter: rate.NewLimiter(rate.Inf, 0), n: 1000},
+		{about: "zero burst", limiter: rate.NewLimiter(10, 0), n: 1, err: true},
+	}
+	for _, c := range cases {
+		started := time.Now()
+		err := waitN(context.Background(), c.limiter, c.n)
+		if (err != nil) != c.err {
+			t.Errorf("%s: got %v, want error %v", c.about, err, c.err)
+		}
+		took := time.Since(started)
+		if took < c.min || took > c.min+time.Second {
+			t.Errorf("%s: took %s, want about %s", c.about, took, c.min)
+		}
+	}
+}
+
+func TestWaitNCancel(t *testing.T) {
+	l := rate.NewLimiter(1, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := waitN(ctx, l, 10); err == nil {
+		t.Errorf("got nil, want an error for a cancelled context")
+	}
+}
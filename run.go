@@ -0,0 +1,664 @@
+package esbulk
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats summarizes a bulk load.
+type Stats struct {
+	Docs      int64         // Documents read.
+	Unsampled int64         // Documents read, but not picked by sampling.
+	Indexed   int64         // Documents accepted by elasticsearch.
+	Failed    int64         // Documents rejected by elasticsearch or skipped.
+	Bytes     int64         // Bytes sent in bulk requests, after compression.
+	Batches   int64         // Bulk requests sent successfully.
+	Elapsed   time.Duration // Time spent reading and indexing.
+	Workers   []WorkerStats // Breakdown by worker.
+}
+
+// WorkerStats are the bulk requests sent by a single worker.
+type WorkerStats struct {
+	Worker  string
+	Indexed int64
+	Failed  int64
+	Bytes   int64
+	Batches int64
+}
+
+// snapshot returns a copy of stats, that are still being updated, adding up
+// the stats kept by each worker.
+func (s *Stats) snapshot(start time.Time, workers []Stats) Stats {
+	stats := Stats{
+		Docs:      atomic.LoadInt64(&s.Docs),
+		Unsampled: atomic.LoadInt64(&s.Unsampled),
+		Failed:    atomic.LoadInt64(&s.Failed),
+		Elapsed:   time.Since(start),
+	}
+	for i := range workers {
+		w := WorkerStats{
+			Worker:  fmt.Sprintf("worker-%d", i),
+			Indexed: atomic.LoadInt64(&workers[i].Indexed),
+			Failed:  atomic.LoadInt64(&workers[i].Failed),
+			Bytes:   atomic.LoadInt64(&workers[i].Bytes),
+			Batches: atomic.LoadInt64(&workers[i].Batches),
+		}
+		stats.Indexed += w.Indexed
+		stats.Failed += w.Failed
+		stats.Bytes += w.Bytes
+		stats.Batches += w.Batches
+		stats.Workers = append(stats.Workers, w)
+	}
+	return stats
+}
+
+// Run reads newline delimited documents, the elements of a JSON array with
+// InputFormat json-array, the rows of a CSV file with InputFormat csv or tsv
+// or the actions of a bulk request body with InputFormat bulk, from a reader
+// and indexes them in batches with Options.Workers parallel workers, after
+// checking the options with Validate. Documents rejected by elasticsearch are
+// counted in the returned stats and do not cause an error, unless FailFast is
+// set. If the context is cancelled, reading stops, pending batches are indexed
+// and the context error is returned. The first error of a worker stops reading
+// and cancels the other workers, along with their requests, and is returned,
+// once all workers are done. If Progress is set, it is called with the current
+// stats every ProgressEvery.
+//
+// Memory is bounded: reading blocks, while all workers are busy sending a
+// batch and QueueSize documents are waiting, so at most Workers batches of
+// BatchSize documents, or BatchBytes, plus QueueSize documents are held at a
+// time, along with the request bodies built from the batches.
+//
+// Positions in the input are lines for ndjson, elements for a JSON array, rows
+// for csv, excluding the header, and actions for bulk, counting from one.
+// Input up to Offset is skipped. Checkpoint, if set, is called when all input
+// up to a position is indexed, rejected or skipped, so a later Run can resume
+// from there.
+func Run(ctx context.Context, options Options, r io.Reader) (Stats, error) {
+	read := inputReader(options.InputFormat)
+	return run(ctx, options, positionName(options.InputFormat), func(ctx context.Context, docs chan<- document, stats *Stats, t *tracker) error {
+		return read(ctx, r, docs, options, stats, t)
+	})
+}
+
+// IndexDocuments indexes a slice of JSON documents, like Run, with the same
+// batching, workers, id extraction and retries, but without reading them
+// from a file. Documents may span multiple lines. Invalid JSON is an error or
+// skipped, if SkipInvalid is set, except for deletes, which may be plain ids.
+// Positions for Offset and Checkpoint are indices into docs, counting from
+// one.
+func IndexDocuments(ctx context.Context, options Options, docs [][]byte) (Stats, error) {
+	return run(ctx, options, "document", func(ctx context.Context, ch chan<- document, stats *Stats, t *tracker) error {
+		var buf bytes.Buffer
+		for i, doc := range docs {
+			pos := int64(i + 1)
+			if options.Limit > 0 && atomic.LoadInt64(&stats.Docs) >= options.Limit {
+				return nil
+			}
+			if pos <= options.Offset {
+				continue
+			}
+			if !options.sampled(stats) {
+				t.ack(pos)
+				continue
+			}
+			// Bulk requests need each document on a single line.
+			buf.Reset()
+			if err := json.Compact(&buf, doc); err != nil {
+				switch {
+				case options.OpType == "delete":
+					buf.Reset()
+					buf.Write(bytes.TrimSpace(doc))
+				case options.SkipInvalid:
+					log.Printf("skipping invalid JSON in document %d: %s", pos, abbreviate(string(doc), 256))
+					atomic.AddInt64(&stats.Docs, 1)
+					atomic.AddInt64(&stats.Failed, 1)
+					t.ack(pos)
+					continue
+				default:
+					return fmt.Errorf("invalid JSON in document %d: %v", pos, err)
+				}
+			}
+			if err := sendDoc(ctx, document{buf.String(), pos}, ch, options, stats); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CountInput returns the number of documents in a reader, read as Run would,
+// with the same InputFormat and handling of invalid documents, but neither
+// limited nor sampled and without sending anything to elasticsearch.
+func CountInput(ctx context.Context, options Options, r io.Reader) (int64, error) {
+	switch options.InputFormat {
+	case "", "ndjson", "json-array", "csv", "tsv", "bulk":
+	default:
+		return 0, fmt.Errorf("unknown input format: %s", options.InputFormat)
+	}
+	options.Limit, options.Sample, options.Offset, options.DocLimiter = 0, 0, 0, nil
+	docs := make(chan document, 1024)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range docs {
+		}
+	}()
+	var stats Stats
+	err := inputReader(options.InputFormat)(ctx, r, docs, options, &stats, nil)
+	close(docs)
+	<-done
+	return stats.Docs - stats.Failed, err
+}
+
+// inputReader returns the function, that reads documents in a format.
+func inputReader(format string) func(context.Context, io.Reader, chan<- document, Options, *Stats, *tracker) error {
+	switch format {
+	case "json-array":
+		return readArray
+	case "csv", "tsv":
+		return readCSV
+	case "bulk":
+		return readBulk
+	default:
+		return readLines
+	}
+}
+
+// readFunc sends documents to the workers of run.
+type readFunc func(ctx context.Context, docs chan<- document, stats *Stats, t *tracker) error
+
+// run indexes the documents sent by read with parallel workers, see Run. The
+// unit names their positions, like line, in errors about single documents.
+func run(ctx context.Context, options Options, unit string, read readFunc) (Stats, error) {
+	var stats Stats
+	if err := options.Validate(); err != nil {
+		return stats, err
+	}
+	start := time.Now()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Workers are not cancelled with the context, so pending batches are
+	// still indexed after reading stopped. The first error of a worker stops
+	// reading and all workers, including their requests in flight, so nothing
+	// is indexed after a fatal error, e.g. if the index was deleted.
+	workCtx, abort := context.WithCancel(context.Background())
+	defer abort()
+
+	workers := options.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	var (
+		wg          sync.WaitGroup
+		once        sync.Once
+		workErr     error // First error of any worker.
+		docs        = make(chan document, options.QueueSize)
+		t           = newTracker(options.Offset, options.Checkpoint)
+		workerStats = make([]Stats, workers)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(id string, ws *Stats) {
+			defer wg.Done()
+			if err := indexLines(workCtx, id, options, nil, docs, unit, t, ws); err != nil {
+				once.Do(func() {
+					workErr = err
+					cancel()
+					abort()
+				})
+				// Keep draining, so the reader does not block.
+				for range docs {
+				}
+			}
+		}(fmt.Sprintf("worker-%d", i), &workerStats[i])
+	}
+
+	// Report progress, until all workers are done.
+	done := make(chan struct{})
+	var reporter sync.WaitGroup
+	if options.ProgressEvery > 0 && options.Progress != nil {
+		reporter.Add(1)
+		go func() {
+			defer reporter.Done()
+			ticker := time.NewTicker(options.ProgressEvery)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					options.Progress(stats.snapshot(start, workerStats))
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	readErr := read(ctx, docs, &stats, t)
+	close(docs)
+	wg.Wait()
+	close(done)
+	reporter.Wait()
+	stats = stats.snapshot(start, workerStats)
+
+	if workErr != nil {
+		return stats, workErr
+	}
+	return stats, readErr
+}
+
+// positionName returns what a position in an input format counts, for error
+// messages, like "line 12".
+func positionName(format string) string {
+	switch format {
+	case "json-array":
+		return "element"
+	case "csv", "tsv":
+		return "row"
+	case "bulk":
+		return "action"
+	}
+	return "line"
+}
+
+// random returns a random number in [0, 1) for sampling.
+func (o Options) random() float64 {
+	if o.Rand != nil {
+		return o.Rand.Float64()
+	}
+	return rand.Float64()
+}
+
+// readLines sends non-empty lines from a reader to a channel until the reader
+// is exhausted or the context is done, counting the lines read. Lines, that are
+// not valid JSON, are an error or skipped, if SkipInvalid is set, except for
+// deletes. Lines starting with #, are ignored, if AllowComments is set. With
+// Sample, only a random fraction of the documents is used. Reading stops after
+// Limit documents, if set, and is throttled by DocLimiter, if set.
+func readLines(ctx context.Context, r io.Reader, docs chan<- document, options Options, stats *Stats, t *tracker) error {
+	reader := bufio.NewReader(r)
+	for lineno := int64(1); options.Limit <= 0 || atomic.LoadInt64(&stats.Docs) < options.Limit; lineno++ {
+		line, err := readLine(reader, options.MaxLineBytes)
+		tooLong := err == errLineTooLong
+		if tooLong {
+			err = nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		// At the end, there is no line, if the input ends with a newline.
+		last := err == io.EOF && len(line) == 0
+		if lineno <= options.Offset {
+			if last {
+				return shortInput(lineno, options.Offset)
+			}
+			if err == io.EOF {
+				return nil
+			}
+			continue
+		}
+		if tooLong {
+			if !options.SkipInvalid {
+				return fmt.Errorf("line %d is longer than %d bytes", lineno, options.MaxLineBytes)
+			}
+			log.Printf("skipping line %d, longer than %d bytes", lineno, options.MaxLineBytes)
+			atomic.AddInt64(&stats.Docs, 1)
+			atomic.AddInt64(&stats.Failed, 1)
+			t.ack(lineno)
+			continue
+		}
+		// The last line may not be terminated by a newline, so we process
+		// any content returned along with io.EOF, before we stop.
+		line = strings.TrimSpace(line)
+		if options.AllowComments && strings.HasPrefix(line, "#") {
+			line = ""
+		}
+		if len(line) > 0 && !options.sampled(stats) {
+			line = ""
+		}
+		if len(line) > 0 {
+			// Only check lines, if asked to, otherwise elasticsearch rejects
+			// invalid documents. Deletes may be plain ids, one per line.
+			validate := options.ValidateJSON || options.SkipInvalid
+			if validate && options.OpType != "delete" && !json.Valid([]byte(line)) {
+				if !options.SkipInvalid {
+					return fmt.Errorf("invalid JSON on line %d: %s", lineno, abbreviate(line, 256))
+				}
+				log.Printf("skipping invalid JSON on line %d: %s", lineno, abbreviate(line, 256))
+				atomic.AddInt64(&stats.Docs, 1)
+				atomic.AddInt64(&stats.Failed, 1)
+				t.ack(lineno)
+				continue
+			}
+			if err := sendDoc(ctx, document{line, lineno}, docs, options, stats); err != nil {
+				return err
+			}
+		} else if !last {
+			t.ack(lineno)
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+	return nil
+}
+
+// errLineTooLong is returned by readLine for a line longer than the maximum.
+var errLineTooLong = errors.New("line too long")
+
+// readLine reads a line, like ReadString, of any length or, if max is
+// positive, up to max bytes, not counting the line break. The rest of a
+// longer line is discarded, without keeping it in memory, and
+// errLineTooLong returned.
+func readLine(reader *bufio.Reader, max int64) (string, error) {
+	if max <= 0 {
+		return reader.ReadString('\n')
+	}
+	var line []byte
+	var n int64
+	for {
+		frag, err := reader.ReadSlice('\n')
+		n += int64(len(bytes.TrimRight(frag, "\r\n")))
+		if n <= max {
+			line = append(line, frag...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if n > max && (err == nil || err == io.EOF) {
+			return "", errLineTooLong
+		}
+		return string(line), err
+	}
+}
+
+// readArray sends the elements of a JSON array from a reader to a channel,
+// like readLines. The array is streamed, so it can be of any size. Elements
+// may span multiple lines and are compacted to a single line.
+func readArray(ctx context.Context, r io.Reader, docs chan<- document, options Options, stats *Stats, t *tracker) error {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("invalid JSON array: %v", err)
+	}
+	if tok != json.Delim('[') {
+		return fmt.Errorf("invalid JSON array: input starts with %v, not [", tok)
+	}
+	var buf bytes.Buffer
+	var n int64
+	for n = 1; dec.More(); n++ {
+		if options.Limit > 0 && atomic.LoadInt64(&stats.Docs) >= options.Limit {
+			return nil
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return fmt.Errorf("invalid JSON in array element %d: %v", n, err)
+		}
+		if n <= options.Offset {
+			continue
+		}
+		if !options.sampled(stats) {
+			t.ack(n)
+			continue
+		}
+		buf.Reset()
+		if err := json.Compact(&buf, raw); err != nil {
+			return err
+		}
+		if err := sendDoc(ctx, document{buf.String(), n}, docs, options, stats); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("invalid JSON array: %v", err)
+	}
+	if n <= options.Offset {
+		return shortInput(n, options.Offset)
+	}
+	return nil
+}
+
+// readBulk sends the actions of a bulk request body, like a dump in bulk
+// format, from a reader to a channel, like readLines. An action line and its
+// source line are sent together as one document, so a batch never separates
+// them; deletes have no source. A source line longer than MaxLineBytes is
+// skipped with its action, if SkipInvalid is set. A long action line is
+// always an error, as the following lines cannot be paired up reliably.
+func readBulk(ctx context.Context, r io.Reader, docs chan<- document, options Options, stats *Stats, t *tracker) error {
+	reader := bufio.NewReader(r)
+	var lineno int64
+	// next returns the next line, that is not blank, or an empty line at the
+	// end of the input, or errLineTooLong.
+	next := func() (string, error) {
+		for {
+			line, err := readLine(reader, options.MaxLineBytes)
+			lineno++
+			if err == errLineTooLong {
+				return "", err
+			}
+			if err != nil && err != io.EOF {
+				return "", err
+			}
+			if line = strings.TrimSpace(line); line != "" || err == io.EOF {
+				return line, nil
+			}
+		}
+	}
+	tooLong := func() error {
+		return fmt.Errorf("line %d is longer than %d bytes", lineno, options.MaxLineBytes)
+	}
+	var n int64
+	for n = 1; options.Limit <= 0 || atomic.LoadInt64(&stats.Docs) < options.Limit; n++ {
+		action, err := next()
+		if err == errLineTooLong {
+			return tooLong()
+		}
+		if err != nil {
+			return err
+		}
+		if action == "" {
+			break
+		}
+		actionLine := lineno
+		op, err := bulkAction(action)
+		if err != nil {
+			return fmt.Errorf("invalid action on line %d: %v: %s", actionLine, err, abbreviate(action, 256))
+		}
+		doc := action
+		if op != "delete" {
+			source, err := next()
+			if err == errLineTooLong {
+				if !options.SkipInvalid {
+					return tooLong()
+				}
+				if n <= options.Offset {
+					continue
+				}
+				log.Printf("skipping %s action on line %d, its source is longer than %d bytes", op, actionLine, options.MaxLineBytes)
+				atomic.AddInt64(&stats.Docs, 1)
+				atomic.AddInt64(&stats.Failed, 1)
+				t.ack(n)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if source == "" {
+				return fmt.Errorf("%s action on line %d has no source", op, actionLine)
+			}
+			if !json.Valid([]byte(source)) {
+				return fmt.Errorf("invalid JSON on line %d: %s", lineno, abbreviate(source, 256))
+			}
+			doc = action + "\n" + source
+		}
+		if n <= options.Offset {
+			continue
+		}
+		if !options.sampled(stats) {
+			t.ack(n)
+			continue
+		}
+		if err := sendDoc(ctx, document{doc, n}, docs, options, stats); err != nil {
+			return err
+		}
+	}
+	if n <= options.Offset {
+		return shortInput(n, options.Offset)
+	}
+	return nil
+}
+
+// bulkAction returns the type of a bulk action line, like index or delete.
+func bulkAction(line string) (string, error) {
+	var action map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(line), &action); err != nil {
+		return "", err
+	}
+	if len(action) != 1 {
+		return "", errors.New("expected a single action")
+	}
+	for op := range action {
+		switch op {
+		case "index", "create", "update", "delete":
+			return op, nil
+		default:
+			return "", fmt.Errorf("unknown action: %s", op)
+		}
+	}
+	return "", nil
+}
+
+// readCSV sends the rows of CSV data from a reader as JSON documents to a
+// channel, like readLines. Field names are taken from CSVColumns or, if not
+// set, the first row. Values are strings, unless CSVTyped is set.
+func readCSV(ctx context.Context, r io.Reader, docs chan<- document, options Options, stats *Stats, t *tracker) error {
+	cr := csv.NewReader(r)
+	cr.ReuseRecord = true
+	switch {
+	case options.CSVDelimiter != 0:
+		cr.Comma = options.CSVDelimiter
+	case options.InputFormat == "tsv":
+		cr.Comma = '\t'
+	}
+	columns := options.CSVColumns
+	if len(columns) == 0 {
+		header, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		columns = append([]string(nil), header...)
+	}
+	cr.FieldsPerRecord = len(columns)
+	var buf bytes.Buffer
+	for n := int64(1); options.Limit <= 0 || atomic.LoadInt64(&stats.Docs) < options.Limit; n++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			if n <= options.Offset {
+				return shortInput(n, options.Offset)
+			}
+			return nil
+		}
+		if n <= options.Offset {
+			continue
+		}
+		if err != nil {
+			var perr *csv.ParseError
+			if !options.SkipInvalid || !errors.As(err, &perr) {
+				return err
+			}
+			log.Printf("skipping invalid row: %v", err)
+			atomic.AddInt64(&stats.Docs, 1)
+			atomic.AddInt64(&stats.Failed, 1)
+			t.ack(n)
+			continue
+		}
+		if !options.sampled(stats) {
+			t.ack(n)
+			continue
+		}
+		buf.Reset()
+		buf.WriteByte('{')
+		for i, value := range record {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(columns[i])
+			buf.Write(key)
+			buf.WriteByte(':')
+			buf.Write(csvValue(value, options.CSVTyped))
+		}
+		buf.WriteByte('}')
+		if err := sendDoc(ctx, document{buf.String(), n}, docs, options, stats); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// csvValue returns a CSV value as JSON string or, if typed is set, as number
+// or boolean, if it looks like one.
+func csvValue(value string, typed bool) []byte {
+	if typed {
+		switch value {
+		case "true", "false":
+			return []byte(value)
+		}
+		if _, err := strconv.ParseFloat(value, 64); err == nil && json.Valid([]byte(value)) {
+			return []byte(value)
+		}
+	}
+	b, _ := json.Marshal(value)
+	return b
+}
+
+// sampled returns true, if a document should be used with Sample, and counts
+// the documents left out.
+func (o Options) sampled(stats *Stats) bool {
+	if o.Sample > 0 && o.Sample < 1 && o.random() >= o.Sample {
+		atomic.AddInt64(&stats.Unsampled, 1)
+		return false
+	}
+	return true
+}
+
+// sendDoc sends a document to the channel, after DocLimiter allows it, and
+// counts it.
+func sendDoc(ctx context.Context, doc document, docs chan<- document, options Options, stats *Stats) error {
+	if err := waitN(ctx, options.DocLimiter, 1); err != nil {
+		return err
+	}
+	select {
+	case docs <- doc:
+		atomic.AddInt64(&stats.Docs, 1)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shortInput returns the error for an input, that ended at position n, before
+// reaching the offset to resume from, as it changed since the checkpoint.
+func shortInput(n, offset int64) error {
+	return fmt.Errorf("input ends at position %d, before offset %d: input changed since checkpoint", n-1, offset)
+}
@@ -0,0 +1,157 @@
+package esbulk
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadLines(t *testing.T) {
+	var cases = []struct {
+		about    string
+		input    string
+		comments bool
+		docs     []document
+	}{
+		{
+			about: "trailing newline",
+			input: "{\"a\": 1}\n{\"a\": 2}\n",
+			docs:  []document{{`{"a": 1}`, 1}, {`{"a": 2}`, 2}},
+		},
+		{
+			about: "no trailing newline",
+			input: "{\"a\": 1}\n{\"a\": 2}",
+			docs:  []document{{`{"a": 1}`, 1}, {`{"a": 2}`, 2}},
+		},
+		{
+			about: "interleaved blank lines",
+			input: "\n{\"a\": 1}\n\n  \t\n{\"a\": 2}\r\n\r\n{\"a\": 3}\n\n",
+			docs:  []document{{`{"a": 1}`, 2}, {`{"a": 2}`, 5}, {`{"a": 3}`, 7}},
+		},
+		{
+			about:    "comments",
+			input:    "# header\n{\"a\": 1}\n\n  # note\n{\"a\": 2}\n",
+			comments: true,
+			docs:     []document{{`{"a": 1}`, 2}, {`{"a": 2}`, 5}},
+		},
+	}
+	for _, c := range cases {
+		docs := make(chan document, 10)
+		var stats Stats
+		if err := readLines(context.Background(), strings.NewReader(c.input), docs, Options{AllowComments: c.comments}, &stats, nil); err != nil {
+			t.Errorf("%s: got %v, want nil", c.about, err)
+			continue
+		}
+		close(docs)
+		var got []document
+		for doc := range docs {
+			got = append(got, doc)
+		}
+		if !reflect.DeepEqual(got, c.docs) {
+			t.Errorf("%s: got %v, want %v", c.about, got, c.docs)
+		}
+		if stats.Docs != int64(len(c.docs)) {
+			t.Errorf("%s: got %d docs counted, want %d", c.about, stats.Docs, len(c.docs))
+		}
+	}
+}
+
+func TestRunValidate(t *testing.T) {
+	input := "{\"a\": 1}\n{\"a\": \n{\"a\": 3}\n"
+	var cases = []struct {
+		about    string
+		validate bool
+		skip     bool
+		err      string
+		failed   int64
+		requests int
+	}{
+		{about: "sent as is", requests: 1},
+		// Documents read before the invalid line are still indexed.
+		{about: "validate", validate: true, err: "invalid JSON on line 2", requests: 1},
+		{about: "skip invalid", skip: true, failed: 1, requests: 1},
+	}
+	for _, c := range cases {
+		srv := newBulkServer(t)
+		options := Options{
+			Servers:      []string{srv.URL},
+			Index:        "x",
+			BatchSize:    10,
+			ValidateJSON: c.validate,
+			SkipInvalid:  c.skip,
+		}
+		stats, err := Run(context.Background(), options, strings.NewReader(input))
+		switch {
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Errorf("%s: got %v, want %s", c.about, err, c.err)
+		case c.err == "" && err != nil:
+			t.Errorf("%s: got %v, want nil", c.about, err)
+		}
+		if stats.Failed != c.failed {
+			t.Errorf("%s: got %d failed, want %d", c.about, stats.Failed, c.failed)
+		}
+		if n := len(srv.requests()); n != c.requests {
+			t.Errorf("%s: got %d requests, want %d", c.about, n, c.requests)
+		}
+	}
+}
+
+func TestRunLongLines(t *testing.T) {
+	// A single document larger than 1MB, followed by a small one.
+	long := `{"a": "` + strings.Repeat("x", 2<<20) + `"}`
+	var cases = []struct {
+		about    string
+		format   string
+		input    string
+		max      int64
+		skip     bool
+		err      string
+		docs     int64
+		failed   int64
+		requests int
+	}{
+		{about: "any length", input: long + "\n{\"a\": 1}\n", docs: 2, requests: 1},
+		{about: "below max", input: long + "\n{\"a\": 1}\n", max: 4 << 20, docs: 2, requests: 1},
+		{about: "above max", input: long + "\n{\"a\": 1}\n", max: 1 << 20, err: "line 1 is longer than 1048576 bytes"},
+		{about: "above max, skipped", input: long + "\n{\"a\": 1}\n", max: 1 << 20, skip: true, docs: 2, failed: 1, requests: 1},
+		{about: "bulk, any length", format: "bulk", input: "{\"index\":{}}\n" + long + "\n{\"index\":{}}\n{\"a\": 1}\n", docs: 2, requests: 1},
+		{about: "bulk, above max", format: "bulk", input: "{\"index\":{}}\n" + long + "\n", max: 1 << 20, err: "line 2 is longer than 1048576 bytes"},
+		{about: "bulk, above max, skipped", format: "bulk", input: "{\"index\":{}}\n" + long + "\n{\"index\":{}}\n{\"a\": 1}\n", max: 1 << 20, skip: true, docs: 2, failed: 1, requests: 1},
+	}
+	for _, c := range cases {
+		srv := newBulkServer(t)
+		options := Options{
+			Servers:      []string{srv.URL},
+			Index:        "x",
+			BatchSize:    10,
+			InputFormat:  c.format,
+			MaxLineBytes: c.max,
+			SkipInvalid:  c.skip,
+		}
+		stats, err := Run(context.Background(), options, strings.NewReader(c.input))
+		switch {
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Errorf("%s: got %v, want %s", c.about, err, c.err)
+		case c.err == "" && err != nil:
+			t.Errorf("%s: got %v, want nil", c.about, err)
+		}
+		if c.err != "" {
+			continue
+		}
+		if stats.Docs != c.docs || stats.Failed != c.failed {
+			t.Errorf("%s: got %d docs, %d failed, want %d, %d", c.about, stats.Docs, stats.Failed, c.docs, c.failed)
+		}
+		requests := srv.requests()
+		if len(requests) != c.requests {
+			t.Errorf("%s: got %d requests, want %d", c.about, len(requests), c.requests)
+			continue
+		}
+		if want := c.docs - c.failed; int64(strings.Count(requests[0], "\n")) != 2*want {
+			t.Errorf("%s: got %d lines in request, want %d", c.about, strings.Count(requests[0], "\n"), 2*want)
+		}
+		if c.failed == 0 && !strings.Contains(requests[0], long) {
+			t.Errorf("%s: long document not sent", c.about)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package esbulk
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+// TemplateFuncs are available in id, index and action templates.
+var TemplateFuncs = template.FuncMap{
+	"date": formatDate,
+	"json": formatJSON,
+}
+
+// formatJSON encodes a value from a document as JSON, to quote strings in an
+// action template, like {"_id": {{json .id}}}.
+func formatJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// dateLayouts are tried in order, when parsing a date from a string.
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// formatDate formats a date value from a document with a go time layout, like
+// "2006.01.02". Strings are parsed as RFC3339 (or some variants), numbers as
+// milliseconds since the epoch.
+func formatDate(layout string, v interface{}) (string, error) {
+	var t time.Time
+	switch value := v.(type) {
+	case json.Number:
+		ms, err := strconv.ParseInt(value.String(), 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("cannot parse date: %v", value)
+		}
+		t = time.Unix(0, ms*int64(time.Millisecond)).UTC()
+	case string:
+		var err error
+		for _, l := range dateLayouts {
+			if t, err = time.Parse(l, value); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return "", fmt.Errorf("cannot parse date: %s", value)
+		}
+	default:
+		return "", fmt.Errorf("cannot parse date: %v", v)
+	}
+	return t.Format(layout), nil
+}